@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"slices"
+
+	"github.com/luc527/go_checkers/core"
+	"github.com/luc527/go_checkers/minimax"
+)
+
+// Plies the machine plays in known positions instead of searching, by
+// position (see positionKey). Stored as JSON in the same form.
+type openingBook map[string][]bookMove
+
+type bookMove struct {
+	Ply core.Ply `json:"ply"`
+	// How likely the ply is to be chosen, relative to the others in the
+	// same position
+	Weight int `json:"weight"`
+}
+
+// Loaded at startup, nil if the server runs without one
+var book openingBook
+
+func loadBook(path string) (openingBook, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readBook(f)
+}
+
+func readBook(r io.Reader) (openingBook, error) {
+	var b openingBook
+	if err := json.NewDecoder(r).Decode(&b); err != nil {
+		return nil, fmt.Errorf("read book: %v", err)
+	}
+	return b, nil
+}
+
+// Picks one of the book plies for the position at random, weighted, or nil
+// if the position isn't in the book
+func (b openingBook) choose(g *core.Game) core.Ply {
+	var moves []bookMove
+	total := 0
+	for _, m := range b[positionKey(g)] {
+		// The book may have been built from games with other rules
+		if m.Weight > 0 && slices.ContainsFunc(g.Plies(), m.Ply.Equals) {
+			moves = append(moves, m)
+			total += m.Weight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	n := rand.Intn(total)
+	for _, m := range moves {
+		if n < m.Weight {
+			return m.Ply
+		}
+		n -= m.Weight
+	}
+	return nil
+}
+
+// Plays from the book while the game is in it, then searches
+type bookSearcher struct {
+	minimax.Searcher
+	book openingBook
+}
+
+func (s bookSearcher) Search(g *core.Game) core.Ply {
+	if ply := s.book.choose(g); ply != nil {
+		return ply
+	}
+	return s.Searcher.Search(g)
+}
+
+func (s bookSearcher) pick(g *core.Game) (core.Ply, string) {
+	return s.book.choose(g), bookSource
+}
+
+func (s bookSearcher) unwrap() minimax.Searcher {
+	return s.Searcher
+}
+
+func (s bookSearcher) with(inner minimax.Searcher) minimax.Searcher {
+	s.Searcher = inner
+	return s
+}
+
+// The book ply for the position if the searcher plays from a book, nil
+// otherwise, along with the searcher to use when there's no book ply, so
+// the book isn't looked up again
+func bookPly(searcher minimax.Searcher, g *core.Game) (core.Ply, minimax.Searcher) {
+	if s, ok := searcher.(bookSearcher); ok {
+		return s.book.choose(g), s.Searcher
+	}
+	return nil, searcher
+}
+
+// How the plies played in a position did, over the stored games
+type bookStats struct {
+	ply   core.Ply
+	games int
+	// 2 for each win and 1 for each draw of the player who played it
+	points int
+}
+
+// Builds a book from the first plies of the stored games that started from
+// the standard position. A ply is only kept if it was played in at least
+// minGames games, weighted by how well it did.
+func buildBook(db store, plies int, minGames int) (openingBook, error) {
+	stats := make(map[string]map[string]*bookStats)
+
+	for _, mode := range []gameMode{humanMode, machineMode, exhibitionMode, tournamentMode} {
+		ids, err := getGameIds(db, mode)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			record, err := getGameRecord(db, mode, id)
+			if err != nil {
+				return nil, fmt.Errorf("game %v: %v", id, err)
+			}
+			if record.Start != nil {
+				continue
+			}
+			result, err := recordResult(record)
+			if err != nil {
+				log.Printf("skipping game %v: %v", id, err)
+				continue
+			}
+			if !result.Over() {
+				continue
+			}
+
+			g := core.NewGame()
+			for _, ply := range record.Plies[:min(plies, len(record.Plies))] {
+				key := positionKey(g)
+				plyKey, err := json.Marshal(ply)
+				if err != nil {
+					return nil, err
+				}
+				if stats[key] == nil {
+					stats[key] = make(map[string]*bookStats)
+				}
+				s := stats[key][string(plyKey)]
+				if s == nil {
+					s = &bookStats{ply: ply}
+					stats[key][string(plyKey)] = s
+				}
+				s.games++
+				if !result.HasWinner() {
+					s.points++
+				} else if result.Winner() == g.ToPlay() {
+					s.points += 2
+				}
+				if _, err := g.DoPly(ply); err != nil {
+					return nil, fmt.Errorf("game %v: %v", id, err)
+				}
+			}
+		}
+	}
+
+	b := make(openingBook)
+	for key, plies := range stats {
+		for _, s := range plies {
+			if s.games >= minGames && s.points > 0 {
+				b[key] = append(b[key], bookMove{Ply: s.ply, Weight: s.points})
+			}
+		}
+	}
+	return b, nil
+}
+
+// Result of the stored game, replaying it if it was stored without one
+func recordResult(record gameRecord) (core.GameResult, error) {
+	if record.Result.Over() {
+		return record.Result, nil
+	}
+	g, err := replayGame(nil, 0, record.Plies)
+	if err != nil {
+		return 0, err
+	}
+	return g.Result(), nil
+}
+
+// Builds the opening book from the games in the database and writes it to a file
+func runBookCommand(args []string) {
+	fs := flag.NewFlagSet("book", flag.ExitOnError)
+	out := fs.String("o", "book.json", "file to write the book to")
+	plies := fs.Int("plies", 10, "how many plies from the start of each game go into the book")
+	minGames := fs.Int("min-games", 2, "games a ply must have been played in to go into the book")
+	fs.Parse(args)
+	if *plies <= 0 {
+		log.Fatalf("invalid -plies %d, must be positive", *plies)
+	}
+	if *minGames <= 0 {
+		log.Fatalf("invalid -min-games %d, must be positive", *minGames)
+	}
+
+	b, err := buildBook(db, *plies, *minGames)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(b); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("wrote book with %d positions to %v", len(b), *out)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxChatLength = 280
+	// How many of the latest chat lines are sent to whoever (re)connects
+	chatBacklogSize = 30
+	// How many chat lines the game keeps for its record, older ones are dropped
+	maxChatTranscript = 500
+	// Each player, and each spectator connection, can send at most chatBurst
+	// chat messages every chatWindow
+	chatBurst  = 5
+	chatWindow = 10 * time.Second
+)
+
+// Who sent a chat line, when it wasn't one of the players
+const spectatorSender = "spectator"
+
+type chatLine struct {
+	// "white", "black" or "spectator"
+	From string    `json:"from"`
+	Text string    `json:"text"`
+	At   time.Time `json:"at"`
+}
+
+// Limits how often a sender can chat
+type chatLimiter struct {
+	sent []time.Time
+}
+
+func (l *chatLimiter) allow(now time.Time) bool {
+	cutoff := now.Add(-chatWindow)
+	i := 0
+	for i < len(l.sent) && !l.sent[i].After(cutoff) {
+		i++
+	}
+	l.sent = l.sent[i:]
+	if len(l.sent) >= chatBurst {
+		return false
+	}
+	l.sent = append(l.sent, now)
+	return true
+}
+
+// Relays the chat message to everyone following the game and keeps it in the
+// transcript
+func (g *conGame) chat(from string, text string) error {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return errors.New("chat: empty message")
+	}
+	if utf8.RuneCountInString(text) > maxChatLength {
+		return fmt.Errorf("chat: message longer than %d characters", maxChatLength)
+	}
+	if g.current().result.Over() {
+		return errors.New("chat: game already over")
+	}
+
+	line := chatLine{From: from, Text: text, At: time.Now()}
+
+	g.chatMu.Lock()
+	defer g.chatMu.Unlock()
+	g.chatLines = append(g.chatLines, line)
+	if over := len(g.chatLines) - maxChatTranscript; over > 0 {
+		g.chatLines = slices.Delete(g.chatLines, 0, over)
+	}
+	g.publish(chatMessageFrom(line))
+	return nil
+}
+
+// Whether the sender may chat now. Players are limited by their color, kept
+// on the game so that reconnecting doesn't reset the limit, and spectators,
+// who can't be told apart otherwise, by their connection.
+func (g *conGame) allowChat(sender any, now time.Time) bool {
+	g.chatMu.Lock()
+	defer g.chatMu.Unlock()
+	if g.chatLimiters == nil {
+		g.chatLimiters = make(map[any]*chatLimiter)
+	}
+	l, ok := g.chatLimiters[sender]
+	if !ok {
+		l = &chatLimiter{}
+		g.chatLimiters[sender] = l
+	}
+	return l.allow(now)
+}
+
+// Drops the limiter of a spectator who left
+func (g *conGame) forgetChatSender(sender any) {
+	g.chatMu.Lock()
+	defer g.chatMu.Unlock()
+	delete(g.chatLimiters, sender)
+}
+
+// The latest chat lines
+func (g *conGame) chatBacklog() []chatLine {
+	g.chatMu.Lock()
+	defer g.chatMu.Unlock()
+	lines := g.chatLines
+	if len(lines) > chatBacklogSize {
+		lines = lines[len(lines)-chatBacklogSize:]
+	}
+	return slices.Clone(lines)
+}
+
+func (g *conGame) chatTranscript() []chatLine {
+	g.chatMu.Lock()
+	defer g.chatMu.Unlock()
+	return slices.Clone(g.chatLines)
+}
+
+// Sends the chat backlog to the client, if there's anything to send
+func (c *client) sendChatBacklog(game *conGame) {
+	if backlog := game.chatBacklog(); len(backlog) > 0 {
+		c.trySend(chatBacklogMessageFrom(backlog))
+	}
+}
+
+// Sends the chat message as from, limited by the sender's limiter
+func (c *client) sendChat(game *conGame, from string, sender any, data chatData) {
+	if !game.allowChat(sender, time.Now()) {
+		c.errorf("chat: too many messages, wait a few seconds")
+		return
+	}
+	if err := game.chat(from, data.Text); err != nil {
+		c.err(err)
+	}
+}
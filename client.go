@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/luc527/go_checkers/core"
 )
@@ -55,6 +56,22 @@ func (c *client) handleFirstMessage() {
 			} else {
 				c.connectToMachineGame(data)
 			}
+		case "mach/exhibition":
+			var data exhibitionNewData
+			if err := json.Unmarshal(envelope.Raw, &data); err != nil {
+				c.err(err)
+				return
+			} else {
+				c.startExhibitionGame(data)
+			}
+		case "exhibition/watch":
+			var data watchData
+			if err := json.Unmarshal(envelope.Raw, &data); err != nil {
+				c.err(err)
+				return
+			} else {
+				c.watchExhibitionGame(data)
+			}
 		case "human/new":
 			var data humanNewData
 			if err := json.Unmarshal(envelope.Raw, &data); err != nil {
@@ -71,6 +88,41 @@ func (c *client) handleFirstMessage() {
 			} else {
 				c.connectToHumanGame(data)
 			}
+		case "human/seek":
+			var data seekData
+			if len(envelope.Raw) > 0 {
+				if err := json.Unmarshal(envelope.Raw, &data); err != nil {
+					c.err(err)
+					return
+				}
+			}
+			c.seekHumanGame(data)
+		case "lobby/subscribe":
+			c.watchLobby()
+		case "lobby/accept":
+			var data lobbyAcceptData
+			if err := json.Unmarshal(envelope.Raw, &data); err != nil {
+				c.err(err)
+				return
+			} else {
+				c.acceptChallenge(data)
+			}
+		case "human/watch":
+			var data watchData
+			if err := json.Unmarshal(envelope.Raw, &data); err != nil {
+				c.err(err)
+				return
+			} else {
+				c.watchHumanGame(data)
+			}
+		case "mach/watch":
+			var data watchData
+			if err := json.Unmarshal(envelope.Raw, &data); err != nil {
+				c.err(err)
+				return
+			} else {
+				c.watchMachineGame(data)
+			}
 		default:
 			c.errorf("unknown message type %q", envelope.Type)
 			return
@@ -86,31 +138,266 @@ func (c *client) trySend(v any) {
 	}
 }
 
-func (c *client) runPlayer(color core.Color, game *conGame) {
-	for bs := range c.incoming {
+// Handles the player's messages until the connection closes, or the game is
+// over and there's no rematch. Returns the rematch if the players agree on one.
+func (c *client) runPlayer(color core.Color, game *conGame, over <-chan struct{}) *rematch {
+	// Set once the game is over, while the players can still agree on a rematch
+	var expired <-chan time.Time
+	// Hints are searched in the background so the other messages aren't held
+	// up, and the game runs one search per player at a time, so the buffer
+	// never fills up
+	hints := make(chan any, 1)
+	for {
+		var bs []byte
+		select {
+		case <-over:
+			over = nil
+			if game.opts.rematchWindow <= 0 || !game.supportsRematch() {
+				return nil
+			}
+			expired = time.After(game.opts.rematchWindow)
+			continue
+		case <-expired:
+			return nil
+		case <-game.rematched:
+			return game.nextGame()
+		case reply := <-hints:
+			c.trySend(reply)
+			continue
+		case msg, ok := <-c.incoming:
+			if !ok {
+				return nil
+			}
+			bs = msg
+		}
+
 		var envelope messageEnvelope
 		if err := json.Unmarshal(bs, &envelope); err != nil {
 			c.err(err)
 			continue
 		}
-		var ply plyData
-		if err := json.Unmarshal(envelope.Raw, &ply); err != nil {
-			c.err(err)
+		switch envelope.Type {
+		case "ply":
+			var ply plyData
+			if err := json.Unmarshal(envelope.Raw, &ply); err != nil {
+				c.err(err)
+				continue
+			}
+			var err error
+			if ply.Notation != "" {
+				err = game.doNotationPly(color, ply.Version, ply.Notation)
+			} else {
+				err = game.doIndexPly(color, ply.Version, ply.Index)
+			}
+			if err != nil {
+				c.err(err)
+			}
+		case "resign":
+			if err := game.resign(color); err != nil {
+				c.err(err)
+			}
+		case "draw/offer":
+			if err := game.offerDraw(color); err != nil {
+				c.err(err)
+			}
+		case "draw/accept":
+			if err := game.acceptDraw(color); err != nil {
+				c.err(err)
+			}
+		case "draw/decline":
+			if err := game.declineDraw(color); err != nil {
+				c.err(err)
+			}
+		case "takeback/request":
+			data := takebackData{Plies: 1}
+			if len(envelope.Raw) > 0 {
+				if err := json.Unmarshal(envelope.Raw, &data); err != nil {
+					c.err(err)
+					continue
+				}
+			}
+			if err := game.requestTakeback(color, data.Plies); err != nil {
+				c.err(err)
+			}
+		case "takeback/accept":
+			if err := game.acceptTakeback(color); err != nil {
+				c.err(err)
+			}
+		case "takeback/decline":
+			if err := game.declineTakeback(color); err != nil {
+				c.err(err)
+			}
+		case "claim":
+			if err := game.claimWin(color); err != nil {
+				c.err(err)
+			}
+		case "chat":
+			var data chatData
+			if err := json.Unmarshal(envelope.Raw, &data); err != nil {
+				c.err(err)
+				continue
+			}
+			c.sendChat(game, color.String(), color, data)
+		case "hint":
+			search, err := game.startHint(color)
+			if err != nil {
+				c.err(err)
+				continue
+			}
+			go func() {
+				if h, err := search(); err != nil {
+					hints <- errorMessage(err.Error())
+				} else {
+					hints <- hintMessageFrom(h)
+				}
+			}()
+		case "rematch/offer":
+			if err := game.offerRematch(color); err != nil {
+				c.err(err)
+			}
+		case "rematch/accept":
+			if err := game.acceptRematch(color); err != nil {
+				c.err(err)
+			}
+		case "rematch/decline":
+			if err := game.declineRematch(color); err != nil {
+				c.err(err)
+			}
+		default:
+			c.errorf("unknown message type %q", envelope.Type)
+		}
+	}
+}
+
+// Whoever is on the other side of the connection
+type viewer struct {
+	spectator bool
+	// Only meaningful when not a spectator
+	color core.Color
+}
+
+func (v viewer) stateMessage(s gameState) gameStateMessage {
+	if v.spectator {
+		return spectatorStateMessageFrom(s)
+	}
+	return gameStateMessageFrom(s, v.color)
+}
+
+// Sends the game events to the client until detached, closing over once the
+// final state is sent
+func (c *client) consumeGameStates(v viewer, events <-chan gameEvent, over chan<- struct{}) {
+	ended := false
+	for ev := range events {
+		if p, ok := ev.(presenceMessage); ok && !v.spectator && p.Color == v.color {
 			continue
 		}
-		version, index := ply.Version, ply.Index
-		if err := game.doIndexPly(color, version, index); err != nil {
-			c.err(err)
+		state, ok := ev.(gameState)
+		if !ok {
+			c.trySend(ev)
+			continue
+		}
+		// States published after the end (e.g. spectator count changes) are
+		// of no interest anymore
+		if ended {
+			continue
+		}
+		c.trySend(v.stateMessage(state))
+		if state.result.Over() {
+			ended = true
+			close(over)
 		}
 	}
 }
 
-func (c *client) consumeGameStates(player core.Color, states <-chan gameState) {
-	defer close(c.outgoing)
-	for state := range states {
-		c.trySend(gameStateMessageFrom(state, player))
-		if state.result.Over() {
+// Follows the game by consuming its events in the background, returning a
+// channel closed once the game is over and a function that stops following it
+func (c *client) follow(v viewer, events chan gameEvent, detach func(chan gameEvent)) (<-chan struct{}, func()) {
+	over := make(chan struct{})
+	consumed := make(chan struct{})
+	go func() {
+		c.consumeGameStates(v, events, over)
+		close(consumed)
+	}()
+	return over, func() {
+		detach(events)
+		<-consumed
+	}
+}
+
+// Closes the connection once the client is done with games
+func (c *client) end() {
+	close(c.outgoing)
+	// Nothing else is sent from now on, just wait for the connection to close
+	for range c.incoming {
+	}
+}
+
+// Plays the game as the player of the given color until the connection closes,
+// or the game is over and the rematch window passes
+func (c *client) play(color core.Color, game *conGame) {
+	// Subscribed before sending the current state, so a state published in
+	// between (e.g. the machine's first ply) isn't missed
+	events := game.playerChannel(color)
+	c.trySend(gameStateMessageFrom(game.current(), color))
+	c.trySend(game.presenceMessage(color.Opposite()))
+	c.sendChatBacklog(game)
+
+	over, stop := c.follow(viewer{color: color}, events, game.detach)
+	next := c.runPlayer(color, game, over)
+	stop()
+
+	if next == nil {
+		c.end()
+		return
+	}
+	c.trySend(rematchStartedMessageFrom(next))
+	next.join(c, color)
+}
+
+// Watches the game as a spectator until the connection closes
+func (c *client) spectate(game *conGame) {
+	// Subscribed before sending the current state, like the players, so no
+	// state published in between is missed
+	events := game.watch()
+	c.trySend(spectatorStateMessageFrom(game.current()))
+	c.trySend(game.presenceMessage(whiteColor))
+	c.trySend(game.presenceMessage(blackColor))
+	c.sendChatBacklog(game)
+
+	over, stop := c.follow(viewer{spectator: true}, events, game.unwatch)
+	c.runSpectator(game, over)
+	stop()
+	game.forgetChatSender(c)
+	c.end()
+}
+
+func (c *client) runSpectator(game *conGame, over <-chan struct{}) {
+	for {
+		var bs []byte
+		select {
+		case <-over:
 			return
+		case msg, ok := <-c.incoming:
+			if !ok {
+				return
+			}
+			bs = msg
+		}
+
+		var envelope messageEnvelope
+		if err := json.Unmarshal(bs, &envelope); err != nil {
+			c.err(err)
+			continue
+		}
+		if envelope.Type != "chat" || !game.opts.spectatorChat {
+			c.errorf("spectators can't send %q messages", envelope.Type)
+			continue
+		}
+		var data chatData
+		if err := json.Unmarshal(envelope.Raw, &data); err != nil {
+			c.err(err)
+			continue
 		}
+		c.sendChat(game, spectatorSender, c, data)
 	}
 }
@@ -3,8 +3,12 @@ package main
 import (
 	"encoding/json"
 	"math/rand"
+	"net/http/httptest"
+	"reflect"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
@@ -83,16 +87,20 @@ func tryState(t *testing.T, m map[string]any) gameStateMessage {
 	}
 
 	var toPlay core.Color
-	var yourColor core.Color
 
 	if err := toPlay.UnmarshalJSON([]byte("\"" + tryGet(t, m, "toPlay").(string) + "\"")); err != nil {
 		t.Logf("invalid toPlay")
 		t.FailNow()
 	}
 
-	if err := yourColor.UnmarshalJSON([]byte("\"" + tryGet(t, m, "yourColor").(string) + "\"")); err != nil {
-		t.Logf("invalid yourColor")
-		t.FailNow()
+	// Spectators don't have a color
+	var yourColor *core.Color
+	if m["spectating"] != true {
+		yourColor = new(core.Color)
+		if err := yourColor.UnmarshalJSON([]byte("\"" + tryGet(t, m, "yourColor").(string) + "\"")); err != nil {
+			t.Logf("invalid yourColor")
+			t.FailNow()
+		}
 	}
 
 	return gameStateMessage{
@@ -118,6 +126,16 @@ func tryMachConnected(t *testing.T, m map[string]any) machConnectedMessage {
 	}
 }
 
+// Reads the next message that's part of the game flow, skipping presence notifications
+func tryReadGame(t *testing.T, conn *websocket.Conn) map[string]any {
+	for {
+		m := tryRead(t, conn)
+		if m["type"] != "presence" && m["type"] != "mach/status" && m["type"] != "mach/thought" {
+			return m
+		}
+	}
+}
+
 // TODO: also test situations where the server should return an error
 
 func TestMachGame(t *testing.T) {
@@ -128,16 +146,17 @@ func TestMachGame(t *testing.T) {
 	trySend(t, conn, tryJson(t, map[string]any{
 		"type": "mach/new",
 		"data": map[string]any{
-			"humanColor":  "white",
-			"heuristic":   "WeightedCount",
-			"timeLimitMs": 100,
+			"humanColor":      "white",
+			"heuristic":       "WeightedCount",
+			"timeLimitMs":     100,
+			"rematchWindowMs": 0,
 		},
 	}))
 
 	tryMachConnected(t, tryRead(t, conn))
 
 	for {
-		m := tryRead(t, conn)
+		m := tryReadGame(t, conn)
 		if m["type"] == "error" {
 			t.Logf("received error: %v", m["message"])
 			t.FailNow()
@@ -196,7 +215,7 @@ func TestMachGameConnect(t *testing.T) {
 		}))
 
 		tryMachConnected(t, tryRead(t, conn))
-		tryState(t, tryRead(t, conn))
+		tryState(t, tryReadGame(t, conn))
 
 		conn.Close()
 		assertClosed(t, cli)
@@ -250,7 +269,8 @@ func TestHumanGame(t *testing.T) {
 	trySend(t, wconn, tryJson(t, map[string]any{
 		"type": "human/new",
 		"data": map[string]any{
-			"color": "white",
+			"color":           "white",
+			"rematchWindowMs": 0,
 		},
 	}))
 
@@ -276,8 +296,8 @@ func TestHumanGame(t *testing.T) {
 
 	for {
 		// TODO check if they got the same states
-		state := tryState(t, tryRead(t, wconn))
-		tryState(t, tryRead(t, bconn))
+		state := tryState(t, tryReadGame(t, wconn))
+		tryState(t, tryReadGame(t, bconn))
 
 		if state.Result.Over() {
 			break
@@ -505,3 +525,979 @@ func TestHumanCreateAndReconnect(t *testing.T) {
 
 	tryHumanConnected(t, tryRead(t, conn))
 }
+
+func startHumanGameConns(t *testing.T) (wcli *client, wconn *websocket.Conn, bcli *client, bconn *websocket.Conn) {
+	return startHumanGameConnsWith(t, map[string]any{
+		"color":           "white",
+		"rematchWindowMs": 0,
+	})
+}
+
+func startHumanGameConnsWith(t *testing.T, data map[string]any) (wcli *client, wconn *websocket.Conn, bcli *client, bconn *websocket.Conn) {
+	wcli, wconn = getClientAndConn(t)
+	go wcli.handleFirstMessage()
+
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "human/new",
+		"data": data,
+	}))
+
+	created := tryHumanCreated(t, tryRead(t, wconn))
+	tryState(t, tryReadGame(t, wconn))
+
+	bcli, bconn = getClientAndConn(t)
+	go bcli.handleFirstMessage()
+
+	trySend(t, bconn, tryJson(t, map[string]any{
+		"type": "human/connect",
+		"data": map[string]any{
+			"id":    created.Id,
+			"token": created.OpponentToken,
+		},
+	}))
+
+	tryHumanConnected(t, tryRead(t, bconn))
+	tryState(t, tryReadGame(t, bconn))
+	return
+}
+
+func TestHumanResign(t *testing.T) {
+	wcli, wconn, bcli, bconn := startHumanGameConns(t)
+
+	trySend(t, bconn, tryJson(t, map[string]any{
+		"type": "resign",
+	}))
+
+	for _, conn := range []*websocket.Conn{wconn, bconn} {
+		m := tryReadGame(t, conn)
+		state := tryState(t, m)
+		if state.Result != core.WhiteWonResult {
+			t.Fatalf("expected white to win by resignation, got %v", state.Result)
+		}
+		if m["reason"] != "resignation" {
+			t.Fatalf("expected resignation reason, got %v", m["reason"])
+		}
+	}
+
+	assertClosed(t, wcli)
+	assertClosed(t, bcli)
+}
+
+func TestHumanDrawAgreement(t *testing.T) {
+	wcli, wconn, bcli, bconn := startHumanGameConns(t)
+
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "draw/offer",
+	}))
+
+	for _, conn := range []*websocket.Conn{wconn, bconn} {
+		m := tryReadGame(t, conn)
+		tryState(t, m)
+		if m["drawOffer"] != "white" {
+			t.Fatalf("expected white's draw offer, got %v", m["drawOffer"])
+		}
+	}
+
+	trySend(t, bconn, tryJson(t, map[string]any{
+		"type": "draw/accept",
+	}))
+
+	for _, conn := range []*websocket.Conn{wconn, bconn} {
+		m := tryReadGame(t, conn)
+		state := tryState(t, m)
+		if state.Result != core.DrawResult || m["reason"] != "agreement" {
+			t.Fatalf("expected draw by agreement, got %v (%v)", state.Result, m["reason"])
+		}
+	}
+
+	assertClosed(t, wcli)
+	assertClosed(t, bcli)
+}
+
+func TestMachDeclinesEvenDraw(t *testing.T) {
+	cli, conn := getClientAndConn(t)
+	go cli.handleFirstMessage()
+
+	trySend(t, conn, tryJson(t, map[string]any{
+		"type": "mach/new",
+		"data": map[string]any{
+			"humanColor":  "white",
+			"heuristic":   "WeightedCount",
+			"timeLimitMs": 100,
+		},
+	}))
+
+	tryMachConnected(t, tryRead(t, conn))
+	tryState(t, tryReadGame(t, conn))
+
+	trySend(t, conn, tryJson(t, map[string]any{
+		"type": "draw/offer",
+	}))
+
+	m := tryReadGame(t, conn)
+	tryState(t, m)
+	if m["drawOffer"] != "white" {
+		t.Fatalf("expected white's draw offer, got %v", m["drawOffer"])
+	}
+
+	m = tryReadGame(t, conn)
+	state := tryState(t, m)
+	if _, ok := m["drawOffer"]; ok || state.Result.Over() {
+		t.Fatal("machine should decline a draw in an even position")
+	}
+
+	conn.Close()
+	assertClosed(t, cli)
+}
+
+func TestMachTakeback(t *testing.T) {
+	cli, conn := getClientAndConn(t)
+	go cli.handleFirstMessage()
+
+	trySend(t, conn, tryJson(t, map[string]any{
+		"type": "mach/new",
+		"data": map[string]any{
+			"humanColor":  "white",
+			"heuristic":   "WeightedCount",
+			"timeLimitMs": 100,
+		},
+	}))
+
+	tryMachConnected(t, tryRead(t, conn))
+	initial := tryState(t, tryReadGame(t, conn))
+
+	trySend(t, conn, tryJson(t, map[string]any{
+		"type": "ply",
+		"data": map[string]any{
+			"version": initial.Version,
+			"ply":     0,
+		},
+	}))
+
+	// Human ply, then machine ply
+	tryState(t, tryReadGame(t, conn))
+	if s := tryState(t, tryReadGame(t, conn)); s.ToPlay != core.WhiteColor {
+		t.Fatal("expected the machine to have played")
+	}
+
+	trySend(t, conn, tryJson(t, map[string]any{
+		"type": "takeback/request",
+		"data": map[string]any{
+			"plies": 1,
+		},
+	}))
+
+	m := tryReadGame(t, conn)
+	tryState(t, m)
+	if _, ok := m["takeback"]; !ok {
+		t.Fatal("expected a pending takeback request")
+	}
+
+	s := tryState(t, tryReadGame(t, conn))
+	if s.ToPlay != core.WhiteColor || s.Board != initial.Board {
+		t.Fatal("expected both the machine's and the human's ply to be taken back")
+	}
+
+	conn.Close()
+	assertClosed(t, cli)
+}
+
+func TestHumanGameClock(t *testing.T) {
+	cli, conn := getClientAndConn(t)
+	go cli.handleFirstMessage()
+
+	trySend(t, conn, tryJson(t, map[string]any{
+		"type": "human/new",
+		"data": map[string]any{
+			"color": "white",
+			"timeControl": map[string]any{
+				"baseMs":      60000,
+				"incrementMs": 1000,
+			},
+		},
+	}))
+
+	tryHumanCreated(t, tryRead(t, conn))
+	m := tryReadGame(t, conn)
+	tryState(t, m)
+
+	clock, ok := tryGet(t, m, "clock").(map[string]any)
+	if !ok {
+		t.Fatal("expected clock to be an object")
+	}
+	if clock["whiteMs"] != float64(60000) || clock["blackMs"] != float64(60000) {
+		t.Fatalf("wrong initial clock %v", clock)
+	}
+	if _, ok := clock["running"]; ok {
+		t.Fatal("clock shouldn't run before the first ply")
+	}
+
+	conn.Close()
+	assertClosed(t, cli)
+}
+
+// Reads messages until one of the given type arrives
+func tryReadType(t *testing.T, conn *websocket.Conn, typ string) map[string]any {
+	for {
+		m := tryRead(t, conn)
+		if m["type"] == typ {
+			return m
+		}
+	}
+}
+
+func TestPresenceAndClaim(t *testing.T) {
+	wcli, wconn := getClientAndConn(t)
+	go wcli.handleFirstMessage()
+
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "human/new",
+		"data": map[string]any{
+			"color":             "white",
+			"disconnectGraceMs": 50,
+			"rematchWindowMs":   0,
+		},
+	}))
+
+	created := tryHumanCreated(t, tryRead(t, wconn))
+
+	m := tryReadType(t, wconn, "presence")
+	if m["color"] != "black" || m["connected"] != false {
+		t.Fatalf("expected black to not be connected yet, got %v", m)
+	}
+
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "claim",
+	}))
+	if e := tryError(t, tryReadType(t, wconn, "error")); !strings.Contains(e.Message, "never connected") {
+		t.Fatalf("shouldn't claim the win before the opponent connects, got %q", e.Message)
+	}
+
+	bcli, bconn := getClientAndConn(t)
+	go bcli.handleFirstMessage()
+
+	trySend(t, bconn, tryJson(t, map[string]any{
+		"type": "human/connect",
+		"data": map[string]any{
+			"id":    created.Id,
+			"token": created.OpponentToken,
+		},
+	}))
+	tryHumanConnected(t, tryRead(t, bconn))
+
+	m = tryReadType(t, wconn, "presence")
+	if m["color"] != "black" || m["connected"] != true {
+		t.Fatalf("expected black to be connected, got %v", m)
+	}
+
+	bconn.Close()
+	assertClosed(t, bcli)
+
+	m = tryReadType(t, wconn, "presence")
+	if m["color"] != "black" || m["connected"] != false {
+		t.Fatalf("expected black to be disconnected, got %v", m)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "claim",
+	}))
+
+	m = tryReadType(t, wconn, "state")
+	state := tryState(t, m)
+	if state.Result != core.WhiteWonResult || m["reason"] != "disconnection" {
+		t.Fatalf("expected white to win by disconnection, got %v (%v)", state.Result, m["reason"])
+	}
+
+	assertClosed(t, wcli)
+}
+
+// Reads states until one reports the given number of spectators
+func tryReadSpectators(t *testing.T, conn *websocket.Conn, n int) map[string]any {
+	for {
+		m := tryReadType(t, conn, "state")
+		if m["spectators"] == float64(n) {
+			return m
+		}
+	}
+}
+
+func TestSpectateHumanGame(t *testing.T) {
+	wcli, wconn := getClientAndConn(t)
+	go wcli.handleFirstMessage()
+
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "human/new",
+		"data": map[string]any{
+			"color":        "white",
+			"privateWatch": true,
+		},
+	}))
+
+	m := tryRead(t, wconn)
+	created := tryHumanCreated(t, m)
+	spectatorToken, _ := m["spectatorToken"].(string)
+	if spectatorToken == "" {
+		t.Fatalf("expected a spectator token for a private game, got %v", m)
+	}
+
+	scli, sconn := getClientAndConn(t)
+	go scli.handleFirstMessage()
+
+	trySend(t, sconn, tryJson(t, map[string]any{
+		"type": "human/watch",
+		"data": map[string]any{
+			"id": created.Id,
+		},
+	}))
+	if e := tryError(t, tryRead(t, sconn)); !strings.Contains(e.Message, "spectator token") {
+		t.Fatalf("expected spectator token error, got %q", e.Message)
+	}
+
+	trySend(t, sconn, tryJson(t, map[string]any{
+		"type": "human/watch",
+		"data": map[string]any{
+			"id":    created.Id,
+			"token": spectatorToken,
+		},
+	}))
+	tryType(t, "human/watching", tryGet(t, tryRead(t, sconn), "type").(string))
+
+	m = tryReadSpectators(t, sconn, 1)
+	if _, ok := m["yourColor"]; ok || m["spectating"] != true {
+		t.Fatalf("spectator state shouldn't have a color, got %v", m)
+	}
+	version := tryState(t, tryReadSpectators(t, wconn, 1)).Version
+
+	trySend(t, sconn, tryJson(t, map[string]any{
+		"type": "ply",
+		"data": map[string]any{
+			"version": version,
+			"ply":     0,
+		},
+	}))
+	if e := tryError(t, tryReadType(t, sconn, "error")); !strings.Contains(e.Message, "spectators can't") {
+		t.Fatalf("expected spectator ply to be rejected, got %q", e.Message)
+	}
+
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "ply",
+		"data": map[string]any{
+			"version": version,
+			"ply":     0,
+		},
+	}))
+	for {
+		state := tryState(t, tryReadType(t, sconn, "state"))
+		if state.Version == version+1 {
+			break
+		}
+	}
+
+	sconn.Close()
+	assertClosed(t, scli)
+	tryReadSpectators(t, wconn, 0)
+
+	wconn.Close()
+	assertClosed(t, wcli)
+}
+
+func TestChatMessages(t *testing.T) {
+	wcli, wconn := getClientAndConn(t)
+	go wcli.handleFirstMessage()
+
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "human/new",
+		"data": map[string]any{
+			"color": "white",
+		},
+	}))
+	created := tryHumanCreated(t, tryRead(t, wconn))
+
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "chat",
+		"data": map[string]any{
+			"text": "good luck",
+		},
+	}))
+	if m := tryReadType(t, wconn, "chat"); m["from"] != "white" || m["text"] != "good luck" {
+		t.Fatalf("unexpected chat message %v", m)
+	}
+
+	scli, sconn := getClientAndConn(t)
+	go scli.handleFirstMessage()
+
+	trySend(t, sconn, tryJson(t, map[string]any{
+		"type": "human/watch",
+		"data": map[string]any{
+			"id": created.Id,
+		},
+	}))
+
+	m := tryReadType(t, sconn, "chat/backlog")
+	if lines := tryGet(t, m, "messages").([]any); len(lines) != 1 {
+		t.Fatalf("expected one line in the backlog, got %v", lines)
+	}
+
+	trySend(t, sconn, tryJson(t, map[string]any{
+		"type": "chat",
+		"data": map[string]any{
+			"text": "hello",
+		},
+	}))
+	if e := tryError(t, tryReadType(t, sconn, "error")); !strings.Contains(e.Message, "spectators can't") {
+		t.Fatalf("spectator chat should be disabled by default, got %q", e.Message)
+	}
+
+	for i := 1; i < chatBurst; i++ {
+		trySend(t, wconn, tryJson(t, map[string]any{
+			"type": "chat",
+			"data": map[string]any{
+				"text": "spam",
+			},
+		}))
+		tryReadType(t, sconn, "chat")
+	}
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "chat",
+		"data": map[string]any{
+			"text": "spam",
+		},
+	}))
+	if e := tryError(t, tryReadType(t, wconn, "error")); !strings.Contains(e.Message, "too many") {
+		t.Fatalf("expected chat to be rate limited, got %q", e.Message)
+	}
+
+	sconn.Close()
+	assertClosed(t, scli)
+	wconn.Close()
+	assertClosed(t, wcli)
+}
+
+func TestHumanSeek(t *testing.T) {
+	seek := func(timeControl map[string]any) (*client, *websocket.Conn) {
+		cli, conn := getClientAndConn(t)
+		go cli.handleFirstMessage()
+		trySend(t, conn, tryJson(t, map[string]any{
+			"type": "human/seek",
+			"data": map[string]any{
+				"timeControl": timeControl,
+			},
+		}))
+		return cli, conn
+	}
+
+	blitz := map[string]any{"baseMs": 180000, "incrementMs": 2000}
+
+	acli, aconn := seek(blitz)
+	tryType(t, "human/seeking", tryGet(t, tryRead(t, aconn), "type").(string))
+
+	// Different time control, so it shouldn't be paired with the first seeker
+	ccli, cconn := seek(nil)
+	tryType(t, "human/seeking", tryGet(t, tryRead(t, cconn), "type").(string))
+
+	bcli, bconn := seek(blitz)
+
+	a := tryHumanConnected(t, tryRead(t, aconn))
+	b := tryHumanConnected(t, tryRead(t, bconn))
+	if a.Id != b.Id {
+		t.Fatalf("seekers should be in the same game, got %v and %v", a.Id, b.Id)
+	}
+	if a.YourColor == b.YourColor {
+		t.Fatalf("seekers should have opposite colors, both got %v", a.YourColor)
+	}
+	if a.YourToken == b.YourToken {
+		t.Fatal("seekers should have different tokens")
+	}
+
+	state := tryState(t, tryReadGame(t, aconn))
+	if state.Result.Over() {
+		t.Fatal("matched game shouldn't be over")
+	}
+
+	cconn.Close()
+	assertClosed(t, ccli)
+	for {
+		seekMu.Lock()
+		n := len(seekers[timeControl{}])
+		seekMu.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	aconn.Close()
+	assertClosed(t, acli)
+	bconn.Close()
+	assertClosed(t, bcli)
+}
+
+func getLobby(t *testing.T) []challenge {
+	rec := httptest.NewRecorder()
+	handleGetLobby(rec, httptest.NewRequest("GET", "/lobby", nil))
+	var challenges []challenge
+	if err := json.Unmarshal(rec.Body.Bytes(), &challenges); err != nil {
+		t.Fatalf("invalid lobby response %q: %v", rec.Body.String(), err)
+	}
+	return challenges
+}
+
+func TestLobby(t *testing.T) {
+	lcli, lconn := getClientAndConn(t)
+	go lcli.handleFirstMessage()
+
+	trySend(t, lconn, tryJson(t, map[string]any{
+		"type": "lobby/subscribe",
+	}))
+	tryType(t, "lobby", tryGet(t, tryRead(t, lconn), "type").(string))
+
+	wcli, wconn := getClientAndConn(t)
+	go wcli.handleFirstMessage()
+
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "human/new",
+		"data": map[string]any{
+			"color": "white",
+			"open":  true,
+		},
+	}))
+	created := tryHumanCreated(t, tryRead(t, wconn))
+
+	m := tryReadType(t, lconn, "lobby/added")
+	ch := tryGet(t, m, "challenge").(map[string]any)
+	if ch["id"] != created.Id.String() || ch["color"] != "black" {
+		t.Fatalf("unexpected challenge %v", ch)
+	}
+
+	listed := slices.ContainsFunc(getLobby(t), func(ch challenge) bool {
+		return ch.Id == created.Id
+	})
+	if !listed {
+		t.Fatal("expected the challenge to be listed in the lobby")
+	}
+
+	trySend(t, lconn, tryJson(t, map[string]any{
+		"type": "lobby/accept",
+		"data": map[string]any{
+			"id": created.Id,
+		},
+	}))
+	connected := tryHumanConnected(t, tryReadType(t, lconn, "human/connected"))
+	if connected.Id != created.Id || connected.YourColor != core.BlackColor {
+		t.Fatalf("expected to join %v as black, got %v as %v", created.Id, connected.Id, connected.YourColor)
+	}
+	tryState(t, tryReadGame(t, lconn))
+
+	listed = slices.ContainsFunc(getLobby(t), func(ch challenge) bool {
+		return ch.Id == created.Id
+	})
+	if listed {
+		t.Fatal("accepted challenge should leave the lobby")
+	}
+
+	// Skip the presence snapshot sent before anyone accepted
+	for m["connected"] != true {
+		m = tryReadType(t, wconn, "presence")
+	}
+	if m["color"] != "black" {
+		t.Fatalf("expected the challenger to see black connect, got %v", m)
+	}
+
+	lconn.Close()
+	assertClosed(t, lcli)
+	wconn.Close()
+	assertClosed(t, wcli)
+}
+
+func TestLobbyCreatorLeaves(t *testing.T) {
+	wcli, wconn := getClientAndConn(t)
+	go wcli.handleFirstMessage()
+
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "human/new",
+		"data": map[string]any{
+			"color": "white",
+			"open":  true,
+		},
+	}))
+	created := tryHumanCreated(t, tryRead(t, wconn))
+
+	wconn.Close()
+	assertClosed(t, wcli)
+
+	// The challenge is closed right after the connection is
+	deadline := time.Now().Add(time.Second)
+	for slices.ContainsFunc(getLobby(t), func(ch challenge) bool {
+		return ch.Id == created.Id
+	}) {
+		if time.Now().After(deadline) {
+			t.Fatal("challenge should leave the lobby once its creator disconnects")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Reads states until the game is over
+func tryReadOver(t *testing.T, conn *websocket.Conn) gameStateMessage {
+	for {
+		state := tryState(t, tryReadType(t, conn, "state"))
+		if state.Result.Over() {
+			return state
+		}
+	}
+}
+
+func TestHumanRematch(t *testing.T) {
+	wcli, wconn, bcli, bconn := startHumanGameConnsWith(t, map[string]any{
+		"color":           "white",
+		"rematchWindowMs": 5000,
+	})
+
+	trySend(t, bconn, tryJson(t, map[string]any{
+		"type": "resign",
+	}))
+	tryReadOver(t, wconn)
+	tryReadOver(t, bconn)
+
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "rematch/offer",
+	}))
+	if m := tryReadType(t, bconn, "rematch/offer"); m["by"] != "white" {
+		t.Fatalf("expected white's rematch offer, got %v", m)
+	}
+
+	trySend(t, bconn, tryJson(t, map[string]any{
+		"type": "rematch/accept",
+	}))
+
+	wstarted := tryReadType(t, wconn, "rematch/started")
+	bstarted := tryReadType(t, bconn, "rematch/started")
+	if wstarted["id"] != bstarted["id"] || wstarted["series"] != bstarted["series"] {
+		t.Fatalf("players should be in the same rematch, got %v and %v", wstarted, bstarted)
+	}
+	if wstarted["series"] == wstarted["id"] {
+		t.Fatal("the series should be named after the first game")
+	}
+
+	w := tryHumanConnected(t, tryRead(t, wconn))
+	b := tryHumanConnected(t, tryRead(t, bconn))
+	if w.YourColor != core.BlackColor || b.YourColor != core.WhiteColor {
+		t.Fatalf("colors should be swapped, got %v and %v", w.YourColor, b.YourColor)
+	}
+	if w.Id.String() != wstarted["id"] {
+		t.Fatalf("expected to join the rematch %v, got %v", wstarted["id"], w.Id)
+	}
+
+	state := tryState(t, tryReadGame(t, bconn))
+	if state.Result.Over() || state.ToPlay != core.WhiteColor {
+		t.Fatal("rematch should start from the beginning")
+	}
+
+	wconn.Close()
+	assertClosed(t, wcli)
+	bconn.Close()
+	assertClosed(t, bcli)
+}
+
+func TestMachRematch(t *testing.T) {
+	cli, conn := getClientAndConn(t)
+	go cli.handleFirstMessage()
+
+	trySend(t, conn, tryJson(t, map[string]any{
+		"type": "mach/new",
+		"data": map[string]any{
+			"humanColor":      "white",
+			"heuristic":       "WeightedCount",
+			"timeLimitMs":     100,
+			"rematchWindowMs": 5000,
+		},
+	}))
+
+	first := tryMachConnected(t, tryRead(t, conn))
+
+	trySend(t, conn, tryJson(t, map[string]any{
+		"type": "resign",
+	}))
+	tryReadOver(t, conn)
+
+	trySend(t, conn, tryJson(t, map[string]any{
+		"type": "rematch/offer",
+	}))
+	started := tryReadType(t, conn, "rematch/started")
+	if started["series"] != first.Id.String() {
+		t.Fatalf("expected the series to be named after %v, got %v", first.Id, started["series"])
+	}
+
+	second := tryMachConnected(t, tryRead(t, conn))
+	if second.YourColor != core.BlackColor {
+		t.Fatalf("expected to play black in the rematch, got %v", second.YourColor)
+	}
+
+	// The machine moves first now
+	for {
+		state := tryState(t, tryReadType(t, conn, "state"))
+		if state.ToPlay == core.BlackColor {
+			break
+		}
+	}
+
+	conn.Close()
+	assertClosed(t, cli)
+}
+
+func TestExhibitionWatch(t *testing.T) {
+	cli, conn := getClientAndConn(t)
+	go cli.handleFirstMessage()
+
+	trySend(t, conn, tryJson(t, map[string]any{
+		"type": "mach/exhibition",
+		"data": map[string]any{
+			"white": map[string]any{"heuristic": "WeightedCount", "timeLimitMs": 100},
+			"black": map[string]any{"heuristic": "Unknown", "timeLimitMs": 100},
+		},
+	}))
+	if e := tryError(t, tryRead(t, conn)); !strings.Contains(e.Message, "black") {
+		t.Fatalf("expected error about black's settings, got %q", e.Message)
+	}
+
+	trySend(t, conn, tryJson(t, map[string]any{
+		"type": "mach/exhibition",
+		"data": map[string]any{
+			"white": map[string]any{"heuristic": "WeightedCount", "timeLimitMs": 100},
+			"black": map[string]any{"heuristic": "UnweightedCount", "timeLimitMs": 100},
+		},
+	}))
+	m := tryRead(t, conn)
+	tryType(t, "exhibition/created", tryGet(t, m, "type").(string))
+	id := tryId(t, tryGet(t, m, "id").(string))
+
+	scli, sconn := getClientAndConn(t)
+	go scli.handleFirstMessage()
+	trySend(t, sconn, tryJson(t, map[string]any{
+		"type": "exhibition/watch",
+		"data": map[string]any{
+			"id": id,
+		},
+	}))
+	tryType(t, "exhibition/watching", tryGet(t, tryRead(t, sconn), "type").(string))
+
+	// Both sides are played by the machine
+	for _, conn := range []*websocket.Conn{conn, sconn} {
+		for {
+			state := tryState(t, tryReadType(t, conn, "state"))
+			if state.Version >= 3 {
+				break
+			}
+		}
+	}
+
+	sconn.Close()
+	assertClosed(t, scli)
+	conn.Close()
+	assertClosed(t, cli)
+}
+
+func TestHumanHint(t *testing.T) {
+	wcli, wconn, bcli, bconn := startHumanGameConnsWith(t, map[string]any{
+		"color": "white",
+		"hints": true,
+	})
+
+	trySend(t, bconn, tryJson(t, map[string]any{
+		"type": "hint",
+	}))
+	if e := tryError(t, tryReadType(t, bconn, "error")); !strings.Contains(e.Message, "not your turn") {
+		t.Fatalf("expected a turn error, got %q", e.Message)
+	}
+
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "hint",
+	}))
+	m := tryReadType(t, wconn, "hint")
+	if m["used"] != 1.0 {
+		t.Fatalf("expected the first hint, got %v", m)
+	}
+
+	// The hinted ply can be played as is
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "ply",
+		"data": map[string]any{
+			"version": m["version"],
+			"index":   m["index"],
+		},
+	}))
+	for _, conn := range []*websocket.Conn{wconn, bconn} {
+		if s := tryState(t, tryReadGame(t, conn)); s.ToPlay != core.BlackColor {
+			t.Fatalf("expected black to play after the hinted ply, got %v", s.ToPlay)
+		}
+	}
+
+	trySend(t, wconn, tryJson(t, map[string]any{
+		"type": "resign",
+	}))
+	tryReadOver(t, wconn)
+	tryReadOver(t, bconn)
+	assertClosed(t, wcli)
+	assertClosed(t, bcli)
+}
+
+func TestMachThought(t *testing.T) {
+	cli, conn := getClientAndConn(t)
+	go cli.handleFirstMessage()
+
+	trySend(t, conn, tryJson(t, map[string]any{
+		"type": "mach/new",
+		"data": map[string]any{
+			"humanColor":      "black",
+			"heuristic":       "WeightedCount",
+			"depthLimit":      3,
+			"thoughtProgress": true,
+		},
+	}))
+	tryMachConnected(t, tryRead(t, conn))
+
+	// The final thought comes once the ply is played
+	var m map[string]any
+	played := false
+	for m == nil {
+		msg := tryRead(t, conn)
+		switch msg["type"] {
+		case "state":
+			played = played || tryState(t, msg).ToPlay == core.BlackColor
+		case "mach/thought":
+			if msg["done"] == true {
+				if !played {
+					t.Fatal("final thought published before the ply")
+				}
+				m = msg
+			}
+		}
+	}
+	if m["color"] != "white" || m["source"] != searchSource {
+		t.Fatalf("unexpected thought %v", m)
+	}
+	if m["depth"] != float64(3) || m["nodes"].(float64) <= 0 || m["score"] == nil {
+		t.Fatalf("expected the search stats, got %v", m)
+	}
+	pv := m["pv"].([]any)
+	if len(pv) != 3 {
+		t.Fatalf("expected a principal variation 3 plies long, got %v", pv)
+	}
+	if !reflect.DeepEqual(pv[0], m["ply"]) {
+		t.Fatalf("principal variation %v doesn't start with the ply %v", pv, m["ply"])
+	}
+
+	conn.Close()
+	assertClosed(t, cli)
+}
+
+func TestMachThoughtProgress(t *testing.T) {
+	cli, conn := getClientAndConn(t)
+	go cli.handleFirstMessage()
+
+	trySend(t, conn, tryJson(t, map[string]any{
+		"type": "mach/new",
+		"data": map[string]any{
+			"humanColor":      "black",
+			"heuristic":       "WeightedCount",
+			"timeLimitMs":     1500,
+			"thoughtProgress": true,
+		},
+	}))
+	tryMachConnected(t, tryRead(t, conn))
+
+	// Progress arrives while the machine is still thinking, not along with
+	// the final thought
+	var progressAt time.Time
+	var m map[string]any
+	for m == nil {
+		msg := tryRead(t, conn)
+		if msg["type"] != "mach/thought" {
+			continue
+		}
+		if msg["done"] == true {
+			m = msg
+		} else if progressAt.IsZero() {
+			progressAt = time.Now()
+		}
+	}
+	if progressAt.IsZero() {
+		t.Fatal("no progress before the final thought")
+	}
+	if elapsed := time.Since(progressAt); elapsed < thoughtProgressInterval/2 {
+		t.Fatalf("progress arrived only %v before the final thought", elapsed)
+	}
+	if m["depth"].(float64) <= 0 || m["nodes"].(float64) <= 0 || m["score"] == nil {
+		t.Fatalf("expected the search stats, got %v", m)
+	}
+
+	conn.Close()
+	assertClosed(t, cli)
+}
+
+func TestMachIdleTimeoutTooShort(t *testing.T) {
+	cli, conn := getClientAndConn(t)
+	go cli.handleFirstMessage()
+
+	trySend(t, conn, tryJson(t, map[string]any{
+		"type": "mach/new",
+		"data": map[string]any{
+			"humanColor":    "black",
+			"heuristic":     "WeightedCount",
+			"timeLimitMs":   3000,
+			"idleTimeoutMs": 1000,
+		},
+	}))
+	if e := tryError(t, tryRead(t, conn)); !strings.Contains(e.Message, "idle timeout") {
+		t.Fatalf("expected error about the idle timeout, got %q", e.Message)
+	}
+
+	conn.Close()
+	assertClosed(t, cli)
+}
+
+func TestGameReplayEndgame(t *testing.T) {
+	table, err := buildEndgameTable(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := endgames
+	endgames = table
+	defer func() { endgames = previous }()
+
+	kings := core.DecodeBoard(`
+		.@......
+		........
+		........
+		........
+		........
+		........
+		........
+		......#.`)
+	game := core.NewCustomGame(stagnantTurnsToDraw(0), kings, core.WhiteColor)
+	record := gameRecord{
+		Result: core.PlayingResult,
+		Start:  &startRecord{Board: *game.Board(), ToPlay: core.WhiteColor},
+		Plies:  []core.Ply{game.Plies()[0]},
+	}
+	id := uuid.New()
+	if err := saveGameRecord(db, humanMode, id, record); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	handleGetGame(rec, httptest.NewRequest("GET", "/game?mode=human&id="+id.String(), nil))
+	var states []map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &states); err != nil {
+		t.Fatalf("invalid game response %q: %v", rec.Body.String(), err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("expected the start and the position after the ply, got %v", states)
+	}
+	for i, s := range states {
+		if _, ok := s["endgame"]; !ok {
+			t.Fatalf("position %d should have its endgame value, got %v", i, s)
+		}
+	}
+}
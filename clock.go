@@ -0,0 +1,118 @@
+package main
+
+import (
+	"time"
+
+	"github.com/luc527/go_checkers/core"
+)
+
+type timeControl struct {
+	base time.Duration
+	// Fischer increment, added to the player's clock after each of their plies
+	increment time.Duration
+	// Simple delay, time at the start of each turn that isn't charged
+	delay time.Duration
+}
+
+func (tc timeControl) enabled() bool {
+	return tc.base > 0
+}
+
+type clockState struct {
+	// Remaining time of each player when the current turn started
+	remaining [2]time.Duration
+	running   bool
+	toPlay    core.Color
+	turnStart time.Time
+	delay     time.Duration
+}
+
+func (c clockState) elapsedAt(now time.Time) time.Duration {
+	if !c.running {
+		return 0
+	}
+	elapsed := now.Sub(c.turnStart) - c.delay
+	if elapsed < 0 {
+		return 0
+	}
+	return elapsed
+}
+
+func (c clockState) remainingAt(color core.Color, now time.Time) time.Duration {
+	rem := c.remaining[color]
+	if c.running && color == c.toPlay {
+		rem -= c.elapsedAt(now)
+	}
+	if rem < 0 {
+		return 0
+	}
+	return rem
+}
+
+// The clock only starts running after the first ply
+type gameClock struct {
+	clockState
+	tc    timeControl
+	timer *time.Timer
+	// Incremented every time the timer is rearmed, so stale timers can be ignored
+	generation int
+}
+
+func newGameClock(tc timeControl) *gameClock {
+	c := &gameClock{tc: tc}
+	c.remaining = [2]time.Duration{tc.base, tc.base}
+	c.delay = tc.delay
+	return c
+}
+
+// Charges the player who just moved and starts the turn of the next player
+func (c *gameClock) switchTurn(now time.Time, next core.Color) {
+	if c.running {
+		mover := c.toPlay
+		c.remaining[mover] = c.remainingAt(mover, now) + c.tc.increment
+	}
+	c.running = true
+	c.toPlay = next
+	c.turnStart = now
+}
+
+// Restarts the turn, charging the time spent so far but with no increment
+func (c *gameClock) restartTurn(now time.Time, toPlay core.Color) {
+	if !c.running {
+		return
+	}
+	c.remaining[c.toPlay] = c.remainingAt(c.toPlay, now)
+	c.toPlay = toPlay
+	c.turnStart = now
+}
+
+func (c *gameClock) stop(now time.Time) {
+	if c.running {
+		c.remaining[c.toPlay] = c.remainingAt(c.toPlay, now)
+		c.running = false
+	}
+	c.disarm()
+}
+
+func (c *gameClock) flagged(now time.Time) bool {
+	return c.running && c.remainingAt(c.toPlay, now) <= 0
+}
+
+func (c *gameClock) disarm() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.generation++
+}
+
+// Arms the timer to call f when the player to move runs out of time
+func (c *gameClock) arm(now time.Time, f func(generation int)) {
+	c.disarm()
+	if !c.running {
+		return
+	}
+	generation := c.generation
+	wait := c.turnStart.Add(c.delay + c.remaining[c.toPlay]).Sub(now)
+	c.timer = time.AfterFunc(wait, func() { f(generation) })
+}
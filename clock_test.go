@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/luc527/go_checkers/core"
+)
+
+func TestClockIncrement(t *testing.T) {
+	c := newGameClock(timeControl{base: time.Minute, increment: 2 * time.Second})
+	start := time.Now()
+
+	if c.running {
+		t.Fatal("clock should only start after the first ply")
+	}
+
+	c.switchTurn(start, core.BlackColor)
+	if got := c.remainingAt(core.WhiteColor, start); got != time.Minute {
+		t.Fatalf("first ply should be free, white has %v", got)
+	}
+
+	now := start.Add(10 * time.Second)
+	if got := c.remainingAt(core.BlackColor, now); got != 50*time.Second {
+		t.Fatalf("black should have 50s, has %v", got)
+	}
+
+	c.switchTurn(now, core.WhiteColor)
+	if got := c.remainingAt(core.BlackColor, now.Add(time.Hour)); got != 52*time.Second {
+		t.Fatalf("black should have 52s after the increment, has %v", got)
+	}
+	if c.flagged(now.Add(59 * time.Second)) {
+		t.Fatal("white shouldn't have flagged yet")
+	}
+	if !c.flagged(now.Add(time.Minute)) {
+		t.Fatal("white should have flagged")
+	}
+}
+
+func TestClockDelay(t *testing.T) {
+	c := newGameClock(timeControl{base: time.Minute, delay: 5 * time.Second})
+	start := time.Now()
+
+	c.switchTurn(start, core.BlackColor)
+	if got := c.remainingAt(core.BlackColor, start.Add(3*time.Second)); got != time.Minute {
+		t.Fatalf("time within the delay shouldn't be charged, black has %v", got)
+	}
+	if got := c.remainingAt(core.BlackColor, start.Add(8*time.Second)); got != 57*time.Second {
+		t.Fatalf("black should have 57s, has %v", got)
+	}
+
+	c.stop(start.Add(8 * time.Second))
+	if got := c.remainingAt(core.BlackColor, start.Add(time.Hour)); got != 57*time.Second {
+		t.Fatalf("stopped clock shouldn't run, black has %v", got)
+	}
+}
+
+func TestFlagFall(t *testing.T) {
+	g := newConGame(gameOptions{timeControl: timeControl{base: 50 * time.Millisecond}})
+	states := g.channel()
+	defer g.detachDraining(states)
+
+	if err := g.doIndexPly(core.WhiteColor, g.current().version, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev := <-states:
+			s, ok := ev.(gameState)
+			if !ok || !s.result.Over() {
+				continue
+			}
+			if s.result != core.WhiteWonResult || s.reason != "timeout" {
+				t.Fatalf("expected white to win on time, got %v (%q)", s.result, s.reason)
+			}
+			return
+		case <-timeout:
+			t.Fatal("black's flag should have fallen")
+		}
+	}
+}
+
+func TestTimeControlData(t *testing.T) {
+	invalid := []timeControlData{
+		{BaseMs: 0},
+		{BaseMs: 1000, IncrementMs: -1},
+		{BaseMs: 1000, IncrementMs: 100, DelayMs: 100},
+	}
+	for _, d := range invalid {
+		if _, err := d.timeControl(); err == nil {
+			t.Fatalf("expected %+v to be invalid", d)
+		}
+	}
+
+	tc, err := timeControlData{BaseMs: 60000, IncrementMs: 500}.timeControl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.base != time.Minute || tc.increment != 500*time.Millisecond {
+		t.Fatalf("wrong time control %+v", tc)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -17,28 +18,112 @@ type gameState struct {
 	board   core.Board
 	toPlay  core.Color
 	result  core.GameResult
+	reason  string
 	plies   []core.Ply
 	version int
+	// Color of the player who offered a draw, nil if there's no pending offer
+	drawOffer *core.Color
+	takeback  *takebackRequest
+	// nil when the game has no time control
+	clock      *clockState
+	spectators int
+	// Engine evaluation of the position, nil until it's computed or when the
+	// game doesn't have it enabled
+	evaluation *float64
+	// Value of the position in the endgame table, when the game has
+	// evaluations enabled and the table covers the position
+	endgame *endgameValue
+}
+
+// Sent to the subscribers of a game: either a gameState, or a message that
+// doesn't change the state (e.g. presence notifications) and is forwarded to
+// the clients as is
+type gameEvent any
+
+type subscriber struct {
+	// Whether the subscriber is one of the players, and which one
+	player    bool
+	color     core.Color
+	spectator bool
 }
 
 type conGame struct {
+	opts gameOptions
+
 	gameMu       sync.Mutex
 	game         *core.Game
 	state        gameState
 	lastActivity atomic.Int64
+	// Machine searches running for the game
+	machineSearches atomic.Int32
+
+	// Done once the game is over, to stop the searches still running for it
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Result imposed from outside the rules of the game (e.g. a resignation),
+	// takes precedence over the result computed by core.Game
+	outcome       core.GameResult
+	outcomeReason string
+
+	drawOffer *core.Color
+	takeback  *takebackRequest
+	clock     *gameClock
+	positions *positionTracker
+	// Set when the game ends because a player stopped playing
+	abandonedBy *core.Color
+	// Indexed by color
+	hintsUsed [2]int
+	// Whether the engine is searching for the player's hint, indexed by color
+	hintSearching [2]bool
 
 	plyHistoryMu sync.Mutex
 	plyHistory   []core.Ply
 
 	chansMu sync.Mutex
-	chans   map[chan gameState]bool
+	chans   map[chan gameEvent]subscriber
+
+	presenceMu sync.Mutex
+	presence   [2]playerPresence
+	spectators int
+
+	// Required to watch the game, empty if anyone can watch
+	spectatorToken string
+
+	chatMu       sync.Mutex
+	chatLines    []chatLine
+	chatLimiters map[any]*chatLimiter
+
+	// Creates the next game of the series, nil if the game mode doesn't
+	// support rematches
+	newRematch func() (*rematch, error)
+	// The machine accepts rematches right away
+	machineOpponent bool
+	rematchOffer    *core.Color
+	next            *rematch
+	// Closed once the players agree on a rematch
+	rematched chan struct{}
+	// Id of the first game of the series, nil if there were no rematches
+	series uuid.UUID
+
+	// Events waiting to be sent to the channels, in order
+	queueMu     sync.Mutex
+	queue       []gameEvent
+	dispatching bool
 }
 
-func newConGame() *conGame {
+func newConGame(opts gameOptions) *conGame {
 	g := &conGame{
-		game:       core.NewGame(),
-		chans:      make(map[chan gameState]bool),
+		opts:       opts,
+		game:       opts.start.newGame(opts.noProgressLimit),
+		chans:      make(map[chan gameEvent]subscriber),
 		plyHistory: make([]core.Ply, 0, 20),
+		rematched:  make(chan struct{}),
+	}
+	g.ctx, g.cancel = context.WithCancel(context.Background())
+	g.positions = newPositionTracker(g.game)
+	if opts.timeControl.enabled() {
+		g.clock = newGameClock(opts.timeControl)
 	}
 	g.registerActivity()
 	g.updateState()
@@ -46,10 +131,21 @@ func newConGame() *conGame {
 }
 
 func (g *conGame) registerActivity() {
-	g.lastActivity.Store(time.Now().Unix())
+	g.lastActivity.Store(time.Now().UnixMilli())
 	// log.Println("registering activity", time.Now())
 }
 
+// The game isn't idle while a machine thinks, however long it takes, so
+// the machine's opponent isn't blamed for it. Returns the function to call
+// once the machine is done.
+func (g *conGame) machineThinking() func() {
+	g.machineSearches.Add(1)
+	return func() {
+		g.registerActivity()
+		g.machineSearches.Add(-1)
+	}
+}
+
 func gameStateFrom(g *core.Game, version int) gameState {
 	return gameState{
 		board:   *g.Board(),
@@ -62,6 +158,22 @@ func gameStateFrom(g *core.Game, version int) gameState {
 
 func (g *conGame) updateState() {
 	g.state = gameStateFrom(g.game, g.state.version+1)
+	g.state.drawOffer = g.drawOffer
+	g.state.takeback = g.takeback
+	g.state.spectators = g.spectatorCount()
+	if g.clock != nil {
+		clock := g.clock.clockState
+		g.state.clock = &clock
+	}
+	if g.outcome.Over() {
+		g.state.result = g.outcome
+		g.state.reason = g.outcomeReason
+		g.state.plies = []core.Ply{}
+	}
+	if g.state.result.Over() {
+		g.cancel()
+	}
+	g.evaluateInner()
 }
 
 func (g *conGame) current() gameState {
@@ -70,42 +182,106 @@ func (g *conGame) current() gameState {
 	return g.state
 }
 
-func (g *conGame) channel() chan gameState {
+func (g *conGame) gameCopy() *core.Game {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+	return g.game.Copy()
+}
+
+// Like gameCopy, also telling for how many plies the special ending has gone
+// on, for the endgame table
+func (g *conGame) positionCopy() (*core.Game, int) {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+	return g.game.Copy(), g.positions.specialPlies()
+}
+
+func (g *conGame) subscribe(sub subscriber) chan gameEvent {
 	g.chansMu.Lock()
 	defer g.chansMu.Unlock()
 
-	c := make(chan gameState)
-	g.chans[c] = true
+	c := make(chan gameEvent)
+	g.chans[c] = sub
+	if sub.player {
+		g.playerJoined(sub.color)
+	}
+	if sub.spectator {
+		g.spectatorJoined()
+	}
 
 	return c
 }
 
-func (g *conGame) detach(c chan gameState) {
+// Subscribes to the game events without being one of the players
+func (g *conGame) channel() chan gameEvent {
+	return g.subscribe(subscriber{})
+}
+
+// Subscribes to the game events as the player of the given color, so their
+// presence is tracked
+func (g *conGame) playerChannel(color core.Color) chan gameEvent {
+	return g.subscribe(subscriber{player: true, color: color})
+}
+
+func (g *conGame) detach(c chan gameEvent) {
 	g.chansMu.Lock()
 	defer g.chansMu.Unlock()
 
-	if _, ok := g.chans[c]; ok {
+	if sub, ok := g.chans[c]; ok {
 		delete(g.chans, c)
 		close(c)
+		if sub.player {
+			g.playerLeft(sub.color)
+		}
+		if sub.spectator {
+			g.spectatorLeft()
+		}
 	}
 }
 
-func (g *conGame) detachAll() {
+func (g *conGame) notify(ev gameEvent) {
 	g.chansMu.Lock()
 	defer g.chansMu.Unlock()
 
 	for c := range g.chans {
-		delete(g.chans, c)
-		close(c)
+		c <- ev
 	}
 }
 
-func (g *conGame) notify(s gameState) {
-	g.chansMu.Lock()
-	defer g.chansMu.Unlock()
+// Queues the event to be sent to all channels without blocking. Events are
+// sent in the same order they're published.
+func (g *conGame) publish(ev gameEvent) {
+	g.queueMu.Lock()
+	defer g.queueMu.Unlock()
 
-	for c := range g.chans {
-		c <- s
+	g.queue = append(g.queue, ev)
+	if !g.dispatching {
+		g.dispatching = true
+		go g.dispatch()
+	}
+}
+
+func (g *conGame) dispatch() {
+	for {
+		g.queueMu.Lock()
+		if len(g.queue) == 0 {
+			g.dispatching = false
+			g.queueMu.Unlock()
+			return
+		}
+		ev := g.queue[0]
+		g.queue = g.queue[1:]
+		g.queueMu.Unlock()
+
+		g.notify(ev)
+	}
+}
+
+// Detaches the channel while still receiving from it, so a notify blocked
+// on sending to it doesn't deadlock with the detach
+func (g *conGame) detachDraining(c chan gameEvent) {
+	go g.detach(c)
+	for range c {
 	}
 }
 
@@ -120,21 +296,55 @@ func (g *conGame) validatePly(player core.Color, version int) error {
 	if s.toPlay != player {
 		return errors.New("do ply: not your turn")
 	}
+	if g.takeback != nil && g.takeback.by != player {
+		return errors.New("do ply: answer the takeback request first")
+	}
+	if g.clock != nil && g.clock.flagged(time.Now()) {
+		return errors.New("do ply: out of time")
+	}
 	return nil
 }
 
 func (g *conGame) doPlyInner(ply core.Ply) error {
+	player := g.game.ToPlay()
+	before := *g.game.Board()
 	if _, err := g.game.DoPly(ply); err != nil {
 		return fmt.Errorf("do ply: %v", err)
 	}
 
+	g.positions.push(&before, g.game)
+	// The core game draws by no progress too, but can't tell why
+	if result := g.game.Result(); !result.Over() || result == core.DrawResult {
+		if reason := g.positions.drawReason(g.opts.noProgressLimit); reason != "" {
+			g.outcome = core.DrawResult
+			g.outcomeReason = reason
+		}
+	}
+
+	// Making a ply instead of answering implicitly declines the draw offer
+	if g.drawOffer != nil && *g.drawOffer != player {
+		g.drawOffer = nil
+	}
+	// Can only be the requesting player's ply, which withdraws the request
+	g.takeback = nil
+
+	if g.clock != nil {
+		now := time.Now()
+		if g.game.Result().Over() || g.outcome.Over() {
+			g.clock.stop(now)
+		} else {
+			g.clock.switchTurn(now, g.game.ToPlay())
+			g.clock.arm(now, g.flagFall)
+		}
+	}
+
 	g.plyHistoryMu.Lock()
 	g.plyHistory = append(g.plyHistory, ply)
 	g.plyHistoryMu.Unlock()
 
 	g.updateState()
 	g.registerActivity()
-	go g.notify(g.state)
+	g.publish(g.state)
 	return nil
 }
 
@@ -167,12 +377,143 @@ func (g *conGame) doIndexPly(player core.Color, version int, index int) error {
 	return nil
 }
 
+func (g *conGame) doNotationPly(player core.Color, version int, notation string) error {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+	if err := g.validatePly(player, version); err != nil {
+		return err
+	}
+	ply, err := plyFromNotation(g.state.plies, notation)
+	if err != nil {
+		return err
+	}
+	return g.doPlyInner(ply)
+}
+
+func winResult(winner core.Color) core.GameResult {
+	if winner == whiteColor {
+		return core.WhiteWonResult
+	}
+	return core.BlackWonResult
+}
+
+// Must be called with gameMu held
+func (g *conGame) endInner(result core.GameResult, reason string) {
+	if g.clock != nil {
+		g.clock.stop(time.Now())
+	}
+	g.outcome = result
+	g.outcomeReason = reason
+	g.updateState()
+	g.registerActivity()
+	g.publish(g.state)
+}
+
+// Called by the clock timer when the player to move may have run out of time
+func (g *conGame) flagFall(generation int) {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+	if g.clock == nil || g.clock.generation != generation || g.state.result.Over() {
+		return
+	}
+	now := time.Now()
+	if !g.clock.flagged(now) {
+		g.clock.arm(now, g.flagFall)
+		return
+	}
+	g.endInner(winResult(g.clock.toPlay.Opposite()), "timeout")
+}
+
+func (g *conGame) resign(player core.Color) error {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+	if g.state.result.Over() {
+		return errors.New("resign: game already over")
+	}
+	g.endInner(winResult(player.Opposite()), "resignation")
+	return nil
+}
+
+func (g *conGame) offerDraw(player core.Color) error {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+	if g.state.result.Over() {
+		return errors.New("offer draw: game already over")
+	}
+	if g.drawOffer != nil {
+		if *g.drawOffer == player {
+			return errors.New("offer draw: already offered")
+		}
+		return errors.New("offer draw: opponent already offered a draw")
+	}
+	g.drawOffer = &player
+	g.state.drawOffer = g.drawOffer
+	g.registerActivity()
+	g.publish(g.state)
+	return nil
+}
+
+// Must be called with gameMu held
+func (g *conGame) validateDrawAnswer(player core.Color) error {
+	if g.state.result.Over() {
+		return errors.New("game already over")
+	}
+	if g.drawOffer == nil || *g.drawOffer == player {
+		return errors.New("no draw offer from the opponent")
+	}
+	return nil
+}
+
+func (g *conGame) acceptDraw(player core.Color) error {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+	if err := g.validateDrawAnswer(player); err != nil {
+		return fmt.Errorf("accept draw: %v", err)
+	}
+	g.drawOffer = nil
+	g.endInner(core.DrawResult, "agreement")
+	return nil
+}
+
+func (g *conGame) declineDraw(player core.Color) error {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+	if err := g.validateDrawAnswer(player); err != nil {
+		return fmt.Errorf("decline draw: %v", err)
+	}
+	g.drawOffer = nil
+	g.state.drawOffer = nil
+	g.registerActivity()
+	g.publish(g.state)
+	return nil
+}
+
 func (g *conGame) copyPlyHistory() []core.Ply {
 	g.plyHistoryMu.Lock()
 	defer g.plyHistoryMu.Unlock()
 	return slices.Clone(g.plyHistory)
 }
 
+func (g *conGame) record() gameRecord {
+	s := g.current()
+	record := gameRecord{
+		Result: s.result,
+		Reason: s.reason,
+		Plies:  g.copyPlyHistory(),
+		Chat:   g.chatTranscript(),
+		Start:  g.opts.start.record(),
+	}
+	g.gameMu.Lock()
+	record.AbandonedBy = g.abandonedBy
+	record.Hints = g.hintsRecordInner()
+	if g.series != uuid.Nil {
+		series := g.series
+		record.Series = &series
+	}
+	g.gameMu.Unlock()
+	return record
+}
+
 func getAndNotifyWebhooks(db store, mode gameMode, id uuid.UUID, state gameState) {
 	if urls, err := getWebhooks(db); err != nil {
 		log.Printf("failed to get webhooks: %v", err)
@@ -181,45 +522,69 @@ func getAndNotifyWebhooks(db store, mode gameMode, id uuid.UUID, state gameState
 	}
 }
 
-func monitorGame[T any](mode gameMode, g *conGame, id uuid.UUID, timeout time.Duration, games map[uuid.UUID]T, mu *sync.Mutex) {
-	ticker := time.NewTicker(30 * time.Second)
+// Ends the game, which has been idle for too long, blaming the player who was
+// supposed to move
+// Ends the game as abandoned by the player to move, unless it saw some
+// activity in the last timeout meanwhile or a machine is still thinking
+func (g *conGame) abandonIfIdle(timeout time.Duration) {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+	if g.state.result.Over() || g.idleFor() < timeout || g.machineSearches.Load() > 0 {
+		return
+	}
+	loser := g.state.toPlay
+	g.abandonedBy = &loser
+	switch g.opts.abandonPolicy {
+	case drawOnAbandon:
+		g.endInner(core.DrawResult, "abandonment")
+	default:
+		g.endInner(winResult(loser.Opposite()), "abandonment")
+	}
+}
+
+func (g *conGame) idleFor() time.Duration {
+	lastActivity := time.UnixMilli(g.lastActivity.Load())
+	return time.Since(lastActivity)
+}
+
+func monitorGame[T any](mode gameMode, g *conGame, id uuid.UUID, games map[uuid.UUID]T, mu *sync.Mutex) {
+	timeout := g.opts.idleTimeout
+	ticker := time.NewTicker(timeout / 4)
+	done := make(chan struct{})
+
+	events := g.channel()
 
 	go func() {
-		states := g.channel()
-		for s := range states {
-			if s.result.Over() {
+		for ev := range events {
+			if s, ok := ev.(gameState); ok && s.result.Over() {
 				ticker.Stop()
+				close(done)
 
 				mu.Lock()
 				delete(games, id)
 				mu.Unlock()
-				g.detach(states)
+				// In case it was an open challenge nobody accepted
+				removeChallenge(id)
 
 				go getAndNotifyWebhooks(db, mode, id, g.current())
-				go savePlyHistory(db, mode, id, g.copyPlyHistory())
+				go saveGameRecord(db, mode, id, g.record())
 
+				g.detachDraining(events)
 				break
 			}
 		}
 	}()
 
 	go func() {
-		for range ticker.C {
-			lastActivity := time.Unix(g.lastActivity.Load(), 0)
-			idleDuration := time.Since(lastActivity)
-			// log.Printf("game idle for %v (id %v)", idleDuration, id)
-			if idleDuration > 2*time.Minute {
-				// log.Printf("closing game (id %v)", id)
-				g.detachAll()
-
-				mu.Lock()
-				delete(games, id)
-				mu.Unlock()
-
-				go getAndNotifyWebhooks(db, mode, id, g.current())
-				go savePlyHistory(db, mode, id, g.copyPlyHistory())
-
-				break
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if g.idleFor() > timeout {
+					// The game ending is then handled like any other
+					g.abandonIfIdle(timeout)
+				}
 			}
 		}
 	}()
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
 	"math/rand"
 	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/luc527/go_checkers/core"
+	"github.com/luc527/go_checkers/minimax"
 )
 
 func generateRandomPlyHistory() []core.Ply {
@@ -31,7 +40,7 @@ func TestPlyHistoryStorage(t *testing.T) {
 
 	db := &memStore{}
 
-	savePlyHistory(db, machineMode, id, actualHistory)
+	saveGameRecord(db, machineMode, id, gameRecord{Plies: actualHistory})
 
 	savedHistory, err := getPlyHistory(db, machineMode, id)
 	if err != nil {
@@ -67,7 +76,7 @@ func TestGetStoredGame(t *testing.T) {
 		history := generateRandomPlyHistory()
 		ids = append(ids, id)
 		modes = append(modes, mode)
-		if err := savePlyHistory(db, mode, id, history); err != nil {
+		if err := saveGameRecord(db, mode, id, gameRecord{Plies: history}); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -109,3 +118,1266 @@ func TestGetStoredGame(t *testing.T) {
 		}
 	}
 }
+
+func TestResign(t *testing.T) {
+	g := newConGame(gameOptions{})
+
+	if err := g.resign(core.WhiteColor); err != nil {
+		t.Fatal(err)
+	}
+
+	s := g.current()
+	if s.result != core.BlackWonResult {
+		t.Fatalf("expected black to win, got %v", s.result)
+	}
+	if s.reason != "resignation" {
+		t.Fatalf("expected resignation reason, got %q", s.reason)
+	}
+	if len(s.plies) != 0 {
+		t.Fatal("finished game should have no plies available")
+	}
+
+	if err := g.resign(core.BlackColor); err == nil {
+		t.Fatal("should not be able to resign a finished game")
+	}
+	if err := g.doIndexPly(core.WhiteColor, s.version, 0); err == nil {
+		t.Fatal("should not be able to play after resignation")
+	}
+
+	record := g.record()
+	if record.Result != core.BlackWonResult || record.Reason != "resignation" {
+		t.Fatalf("record does not reflect resignation: %+v", record)
+	}
+}
+
+func TestDrawOffer(t *testing.T) {
+	g := newConGame(gameOptions{})
+
+	if err := g.acceptDraw(core.BlackColor); err == nil {
+		t.Fatal("should not accept a draw that was never offered")
+	}
+	if err := g.offerDraw(core.WhiteColor); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.offerDraw(core.WhiteColor); err == nil {
+		t.Fatal("should not offer a draw twice")
+	}
+	if err := g.acceptDraw(core.WhiteColor); err == nil {
+		t.Fatal("should not accept own draw offer")
+	}
+	if offer := g.current().drawOffer; offer == nil || *offer != core.WhiteColor {
+		t.Fatal("state should show white's draw offer")
+	}
+
+	if err := g.declineDraw(core.BlackColor); err != nil {
+		t.Fatal(err)
+	}
+	if g.current().drawOffer != nil {
+		t.Fatal("declined offer should be cleared")
+	}
+
+	// The offer stands after the offering player's ply, but lapses after the opponent's
+	if err := g.offerDraw(core.WhiteColor); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.doIndexPly(core.WhiteColor, g.current().version, 0); err != nil {
+		t.Fatal(err)
+	}
+	if g.current().drawOffer == nil {
+		t.Fatal("offer should stand after the offering player's ply")
+	}
+	if err := g.doIndexPly(core.BlackColor, g.current().version, 0); err != nil {
+		t.Fatal(err)
+	}
+	if g.current().drawOffer != nil {
+		t.Fatal("offer should lapse after the opponent's ply")
+	}
+
+	if err := g.offerDraw(core.BlackColor); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.acceptDraw(core.WhiteColor); err != nil {
+		t.Fatal(err)
+	}
+	s := g.current()
+	if s.result != core.DrawResult || s.reason != "agreement" {
+		t.Fatalf("expected draw by agreement, got %v (%q)", s.result, s.reason)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	g := core.NewGame()
+	before := g.Copy()
+
+	if v := evaluate(g, minimax.WeightedCountHeuristic, core.WhiteColor, 3); v != drawValue {
+		t.Fatalf("initial position should be even, got %v", v)
+	}
+	if !g.Equals(before) {
+		t.Fatal("evaluate should leave the game as it was")
+	}
+
+	// White king against a lone black pawn
+	b := core.DecodeBoard(`
+		........
+		........
+		........
+		...x....
+		........
+		........
+		........
+		......@.
+	`)
+	g = core.NewCustomGame(20, b, core.WhiteColor)
+	if v := evaluate(g, minimax.WeightedCountHeuristic, core.WhiteColor, 2); v <= drawValue {
+		t.Fatalf("white should be better, got %v", v)
+	}
+	if v := evaluate(g, minimax.WeightedCountHeuristic, core.BlackColor, 2); v >= drawValue {
+		t.Fatalf("black should be worse, got %v", v)
+	}
+}
+
+func TestTakeback(t *testing.T) {
+	g := newConGame(gameOptions{})
+	initial := g.current()
+
+	if err := g.requestTakeback(core.WhiteColor, 1); err == nil {
+		t.Fatal("should not take back when no plies were made")
+	}
+
+	if err := g.doIndexPly(core.WhiteColor, g.current().version, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.doIndexPly(core.BlackColor, g.current().version, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.requestTakeback(core.BlackColor, 3); err == nil {
+		t.Fatal("should not take back more plies than were made")
+	}
+	if err := g.requestTakeback(core.BlackColor, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.doIndexPly(core.WhiteColor, g.current().version, 0); err == nil {
+		t.Fatal("should not play while a takeback request is pending")
+	}
+	if err := g.acceptTakeback(core.BlackColor); err == nil {
+		t.Fatal("should not accept own takeback request")
+	}
+	if err := g.declineTakeback(core.WhiteColor); err != nil {
+		t.Fatal(err)
+	}
+	if g.current().takeback != nil {
+		t.Fatal("declined request should be cleared")
+	}
+
+	if err := g.requestTakeback(core.WhiteColor, 2); err != nil {
+		t.Fatal(err)
+	}
+	before := g.current().version
+	if err := g.acceptTakeback(core.BlackColor); err != nil {
+		t.Fatal(err)
+	}
+
+	s := g.current()
+	if s.version <= before {
+		t.Fatal("takeback should bump the version")
+	}
+	if s.takeback != nil {
+		t.Fatal("accepted request should be cleared")
+	}
+	if s.board != initial.board || s.toPlay != initial.toPlay {
+		t.Fatal("should be back to the initial position")
+	}
+	if len(g.copyPlyHistory()) != 0 {
+		t.Fatal("ply history should be empty")
+	}
+}
+
+func TestMachineTakebackTooLong(t *testing.T) {
+	g := newConGame(gameOptions{})
+	g.machineOpponent = true
+
+	if err := g.doIndexPly(core.WhiteColor, g.current().version, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Putting black back on move would need two plies
+	if err := g.requestTakeback(core.BlackColor, 1); err == nil {
+		t.Fatal("should not request a takeback the machine can't honour")
+	}
+	if err := g.requestTakeback(core.WhiteColor, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAbandonment(t *testing.T) {
+	for _, policy := range []abandonPolicy{forfeitOnAbandon, drawOnAbandon} {
+		opts := gameOptions{
+			idleTimeout:   100 * time.Millisecond,
+			abandonPolicy: policy,
+		}
+		g := newConGame(opts)
+		id := uuid.New()
+
+		mu := sync.Mutex{}
+		games := map[uuid.UUID]*conGame{id: g}
+
+		states := g.channel()
+		monitorGame(humanMode, g, id, games, &mu)
+
+		var s gameState
+		for ev := range states {
+			if state, ok := ev.(gameState); ok && state.result.Over() {
+				s = state
+				break
+			}
+		}
+		go g.detachDraining(states)
+
+		want := core.BlackWonResult
+		if policy == drawOnAbandon {
+			want = core.DrawResult
+		}
+		if s.result != want || s.reason != "abandonment" {
+			t.Fatalf("%v: expected %v by abandonment, got %v (%q)", policy, want, s.result, s.reason)
+		}
+
+		record := g.record()
+		if record.AbandonedBy == nil || *record.AbandonedBy != core.WhiteColor {
+			t.Fatalf("%v: expected white to be recorded as having abandoned the game", policy)
+		}
+	}
+}
+
+func TestMachineThinkingIsNotAbandonment(t *testing.T) {
+	timeout := 100 * time.Millisecond
+	g := newConGame(gameOptions{idleTimeout: timeout})
+	g.machineOpponent = true
+	id := uuid.New()
+	mu := sync.Mutex{}
+	games := map[uuid.UUID]*conGame{id: g}
+
+	states := g.channel()
+	monitorGame(machineMode, g, id, games, &mu)
+	h := minimax.WeightedCountHeuristic
+	machine := newMachinePlayer(core.WhiteColor, minimax.TimeLimitedSearcher{Heuristic: h, TimeLimit: 4 * timeout}, h)
+	go machine.run(g)
+
+	// The machine takes longer than the idle timeout, then black gets the
+	// whole timeout to answer
+	var playedAt time.Time
+	var s gameState
+	for ev := range states {
+		state, ok := ev.(gameState)
+		if !ok {
+			continue
+		}
+		if state.toPlay == core.BlackColor && playedAt.IsZero() {
+			playedAt = time.Now()
+		}
+		if state.result.Over() {
+			s = state
+			break
+		}
+	}
+	go g.detachDraining(states)
+
+	if playedAt.IsZero() {
+		t.Fatalf("game abandoned while the machine was thinking (%q)", s.reason)
+	}
+	// Some leeway for the state taking a while to get here
+	if elapsed := time.Since(playedAt); elapsed < timeout/2 {
+		t.Fatalf("black abandoned the game only %v after the machine played", elapsed)
+	}
+	if record := g.record(); record.AbandonedBy == nil || *record.AbandonedBy != core.BlackColor {
+		t.Fatal("expected black to be recorded as having abandoned the game")
+	}
+}
+
+func TestChat(t *testing.T) {
+	g := newConGame(gameOptions{})
+
+	if err := g.chat("white", "   "); err == nil {
+		t.Fatal("empty chat message should be rejected")
+	}
+	if err := g.chat("white", strings.Repeat("a", maxChatLength+1)); err == nil {
+		t.Fatal("chat message over the length limit should be rejected")
+	}
+
+	for i := 0; i < chatBacklogSize+5; i++ {
+		if err := g.chat("black", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backlog := g.chatBacklog()
+	if len(backlog) != chatBacklogSize || backlog[0].Text != "5" {
+		t.Fatalf("expected the backlog to have the latest %d lines, got %v", chatBacklogSize, backlog)
+	}
+
+	g.resign(core.WhiteColor)
+	if err := g.chat("white", "gg"); err == nil {
+		t.Fatal("shouldn't be able to chat after the game is over")
+	}
+
+	record := g.record()
+	if len(record.Chat) != chatBacklogSize+5 {
+		t.Fatalf("expected the whole transcript in the record, got %d lines", len(record.Chat))
+	}
+}
+
+func TestChatTranscriptCap(t *testing.T) {
+	g := newConGame(gameOptions{})
+	for i := 0; i < maxChatTranscript+5; i++ {
+		if err := g.chat("white", fmt.Sprint(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lines := g.chatTranscript()
+	if len(lines) != maxChatTranscript || lines[0].Text != "5" {
+		t.Fatalf("expected the latest %d lines, got %d starting at %q", maxChatTranscript, len(lines), lines[0].Text)
+	}
+}
+
+func TestChatLimiter(t *testing.T) {
+	var l chatLimiter
+	now := time.Now()
+	for i := 0; i < chatBurst; i++ {
+		if !l.allow(now) {
+			t.Fatalf("message %d should be allowed", i)
+		}
+	}
+	if l.allow(now) {
+		t.Fatal("message over the burst should be limited")
+	}
+	if !l.allow(now.Add(chatWindow + time.Millisecond)) {
+		t.Fatal("message after the window should be allowed")
+	}
+
+	g := newConGame(gameOptions{})
+	spectators := []*client{{}, {}}
+	for i := 0; i < chatBurst; i++ {
+		g.allowChat(core.WhiteColor, now)
+		g.allowChat(spectators[0], now)
+	}
+	if g.allowChat(core.WhiteColor, now) {
+		t.Fatal("the game should keep limiting the sender")
+	}
+	if g.allowChat(spectators[0], now) {
+		t.Fatal("the game should keep limiting the spectator")
+	}
+	if !g.allowChat(core.BlackColor, now) {
+		t.Fatal("senders should be limited separately")
+	}
+	if !g.allowChat(spectators[1], now) {
+		t.Fatal("each spectator should be limited separately")
+	}
+	g.forgetChatSender(spectators[0])
+	if len(g.chatLimiters) != 3 {
+		t.Fatalf("the limiter of a spectator who left should be dropped, got %d limiters", len(g.chatLimiters))
+	}
+}
+
+func TestExhibitionGame(t *testing.T) {
+	player := func(color core.Color, h minimax.Heuristic) machinePlayer {
+		return newMachinePlayer(color, minimax.DepthLimitedSearcher{Heuristic: h, DepthLimit: 1}, h)
+	}
+	white := player(core.WhiteColor, minimax.WeightedCountHeuristic)
+	black := player(core.BlackColor, minimax.UnweightedCountHeuristic)
+
+	eg, err := newExhibitionGame(white, black, gameOptions{idleTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := eg.channel()
+	registerExhibitionGame(eg)
+
+	var s gameState
+	for ev := range states {
+		if state, ok := ev.(gameState); ok && state.result.Over() {
+			s = state
+			break
+		}
+	}
+	go eg.detachDraining(states)
+
+	if len(eg.copyPlyHistory()) == 0 {
+		t.Fatal("expected both machines to play")
+	}
+
+	// The record is saved in the background once the game is over
+	for i := 0; i < 100; i++ {
+		if record, err := getGameRecord(db, exhibitionMode, eg.id); err == nil && record.Result == s.result {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expected the exhibition game to be stored")
+}
+
+func TestStartPosition(t *testing.T) {
+	invalid := []string{
+		"52wp25b",      // truncated
+		"52wp25bp52bp", // two pieces on the same square
+		"44wp25bp",     // light square
+		"01wp25bp",     // white pawn on its crowning row
+		"52wp70bp",     // black pawn on its crowning row
+		"52wp",         // no black pieces, game already over
+	}
+	for _, board := range invalid {
+		if _, err := startPositionFrom(board, core.WhiteColor); err == nil {
+			t.Errorf("start position %q should be invalid", board)
+		}
+	}
+
+	black := core.BlackColor
+	if _, err := (gameOptionsData{ToPlay: &black}).options(); err == nil || !strings.Contains(err.Error(), "needs a board") {
+		t.Fatalf("toPlay without a board should be rejected, got %v", err)
+	}
+
+	start, err := startPositionFrom("54wp25bp70bk", core.BlackColor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newConGame(gameOptions{start: start})
+	initial := g.current()
+	if initial.toPlay != core.BlackColor {
+		t.Fatalf("black should be to play, got %v", initial.toPlay)
+	}
+	if !sameBoard(initial.board, start.board) {
+		t.Fatal("game should start from the given board")
+	}
+
+	if err := g.doIndexPly(core.BlackColor, initial.version, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.requestTakeback(core.BlackColor, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.acceptTakeback(core.WhiteColor); err != nil {
+		t.Fatal(err)
+	}
+	if s := g.current(); !sameBoard(s.board, initial.board) || s.toPlay != initial.toPlay {
+		t.Fatal("takeback should go back to the start position")
+	}
+
+	record := g.record()
+	if record.Start == nil || !sameBoard(record.Start.Board, start.board) || record.Start.ToPlay != core.BlackColor {
+		t.Fatal("record should include the start position")
+	}
+	if !sameBoard(*record.Start.initialBoard(), start.board) {
+		t.Fatal("replay should start from the start position")
+	}
+	if newConGame(gameOptions{}).record().Start != nil {
+		t.Fatal("standard games shouldn't store a start position")
+	}
+}
+
+// Compares boards by their pieces only, since the game may leave stray bits
+// behind on empty squares
+func sameBoard(a, b core.Board) bool {
+	sa, _ := a.Serialize()
+	sb, _ := b.Serialize()
+	return string(sa) == string(sb)
+}
+
+// Does the ply that moves the player's piece between the given squares
+func doPlyBetween(t *testing.T, g *conGame, player core.Color, fromRow, fromCol, toRow, toCol byte) {
+	t.Helper()
+	s := g.current()
+	for i, ply := range s.plies {
+		game := g.gameCopy()
+		if _, err := game.DoPly(ply); err != nil {
+			t.Fatal(err)
+		}
+		after := game.Board()
+		if after.IsOccupied(fromRow, fromCol) || !after.IsOccupied(toRow, toCol) {
+			continue
+		}
+		if c, _ := after.Get(toRow, toCol); c == player {
+			if err := g.doIndexPly(player, s.version, i); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+	t.Fatalf("no ply from (%d, %d) to (%d, %d)", fromRow, fromCol, toRow, toCol)
+}
+
+func TestDrawRules(t *testing.T) {
+	// Three kings each, so it's not one of the special endings core.Game
+	// already draws
+	start, err := startPositionFrom("70wk72wk74wk01bk03bk05bk", core.WhiteColor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// There and back again
+	shuffle := func(g *conGame) {
+		doPlyBetween(t, g, core.WhiteColor, 7, 4, 6, 3)
+		doPlyBetween(t, g, core.BlackColor, 0, 5, 1, 4)
+		doPlyBetween(t, g, core.WhiteColor, 6, 3, 7, 4)
+		doPlyBetween(t, g, core.BlackColor, 1, 4, 0, 5)
+	}
+
+	g := newConGame(gameOptions{start: start})
+	shuffle(g)
+	if g.current().result.Over() {
+		t.Fatal("should not be drawn after the second repetition")
+	}
+
+	// Taking back forgets the positions that were undone
+	if err := g.requestTakeback(core.WhiteColor, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.acceptTakeback(core.BlackColor); err != nil {
+		t.Fatal(err)
+	}
+	doPlyBetween(t, g, core.WhiteColor, 6, 3, 7, 4)
+	doPlyBetween(t, g, core.BlackColor, 1, 4, 0, 5)
+	if g.current().result.Over() {
+		t.Fatal("should not be drawn after the second repetition, even with a takeback in between")
+	}
+
+	shuffle(g)
+	if s := g.current(); s.result != core.DrawResult || s.reason != repetitionReason {
+		t.Fatalf("want draw by %s, got %v (%q)", repetitionReason, s.result, s.reason)
+	}
+	if r := g.record(); r.Reason != repetitionReason {
+		t.Fatalf("record should have the draw reason, got %q", r.Reason)
+	}
+
+	g = newConGame(gameOptions{start: start, noProgressLimit: 3})
+	doPlyBetween(t, g, core.WhiteColor, 7, 4, 6, 3)
+	doPlyBetween(t, g, core.BlackColor, 0, 5, 1, 4)
+	if g.current().result.Over() {
+		t.Fatal("should not be drawn before the limit")
+	}
+	// Searches run on copies of the game, which should see the draw coming
+	searched := g.gameCopy()
+	drawn := false
+	for _, ply := range core.CopyPlies(searched.Plies()) {
+		after := searched.Copy()
+		after.DoPly(ply)
+		drawn = drawn || after.Result() == core.DrawResult
+	}
+	if !drawn {
+		t.Fatal("searched game should know about the no-progress limit")
+	}
+	doPlyBetween(t, g, core.WhiteColor, 6, 3, 7, 4)
+	if s := g.current(); s.result != core.DrawResult || s.reason != noProgressReason {
+		t.Fatalf("want draw by %s, got %v (%q)", noProgressReason, s.result, s.reason)
+	}
+
+	// Pawn moves are progress
+	g = newConGame(gameOptions{noProgressLimit: 1})
+	if err := g.doIndexPly(core.WhiteColor, g.current().version, 0); err != nil {
+		t.Fatal(err)
+	}
+	if g.current().result.Over() {
+		t.Fatal("pawn move should not count towards the no-progress limit")
+	}
+}
+
+func TestHint(t *testing.T) {
+	g := newConGame(gameOptions{})
+	if _, err := g.hint(core.WhiteColor); err == nil {
+		t.Fatal("hints should not be allowed by default")
+	}
+	if g.record().Hints != nil {
+		t.Fatal("should not record hints when they're not allowed")
+	}
+
+	g = newConGame(gameOptions{hints: true})
+	if _, err := g.hint(core.BlackColor); err == nil {
+		t.Fatal("should not give hints out of turn")
+	}
+
+	for i := 1; i <= 2; i++ {
+		h, err := g.hint(core.WhiteColor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := g.current()
+		if h.version != s.version || h.index < 0 || h.index >= len(s.plies) {
+			t.Fatalf("invalid hint %+v", h)
+		}
+		if h.used != i {
+			t.Fatalf("want %d hints used, got %d", i, h.used)
+		}
+	}
+
+	search, err := g.startHint(core.WhiteColor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.hint(core.WhiteColor); err == nil {
+		t.Fatal("should not search for a second hint while the first is searched for")
+	}
+	if _, err := search(); err != nil {
+		t.Fatal(err)
+	}
+
+	if hints := g.record().Hints; hints == nil || hints.White != 3 || hints.Black != 0 {
+		t.Fatalf("want 3 hints used by white, got %+v", hints)
+	}
+}
+
+func TestLiveEvaluation(t *testing.T) {
+	if _, err := (evaluationData{Depth: maxEvaluationDepth + 1}).liveEvaluation(); err == nil {
+		t.Fatal("should not allow too deep an evaluation")
+	}
+	if _, err := (evaluationData{Heuristic: "nonsense"}).liveEvaluation(); err == nil {
+		t.Fatal("should not allow unknown heuristics")
+	}
+
+	e, err := evaluationData{Depth: 2}.liveEvaluation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newConGame(gameOptions{evaluation: e})
+	events := g.channel()
+	defer g.detachDraining(events)
+
+	if err := g.doIndexPly(core.WhiteColor, g.current().version, 0); err != nil {
+		t.Fatal(err)
+	}
+	version := g.current().version
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			s, ok := ev.(gameState)
+			if !ok || s.evaluation == nil {
+				continue
+			}
+			if s.version != version {
+				continue
+			}
+			want := evaluate(g.gameCopy(), e.heuristic, whiteColor, e.depth)
+			if *s.evaluation != want {
+				t.Fatalf("want evaluation %v, got %v", want, *s.evaluation)
+			}
+			return
+		case <-timeout:
+			t.Fatal("evaluation never arrived")
+		}
+	}
+}
+
+func TestDifficultyLevels(t *testing.T) {
+	for _, level := range difficultyLevels {
+		if _, _, err := (searcherData{Level: level}).searcher(); err != nil {
+			t.Fatalf("level %v: %v", level, err)
+		}
+	}
+	if _, _, err := (searcherData{Level: "grandmaster"}).searcher(); err == nil {
+		t.Fatal("should not accept unknown levels")
+	}
+	if _, _, err := (searcherData{Level: "expert", TimeLimitMs: 100}).searcher(); err == nil {
+		t.Fatal("should not accept both a level and a time limit")
+	}
+
+	searcher, _, err := searcherData{Level: "advanced"}.searcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, ok := searcherFor(searcher, core.BlackColor).(blunderingSearcher)
+	if !ok {
+		t.Fatalf("advanced level should blunder every now and then, got %T", searcher)
+	}
+	inner, ok := budgeted(s, 100*time.Millisecond).(blunderingSearcher).Searcher.(minimax.TimeLimitedSearcher)
+	if !ok || inner.ToMax != core.BlackColor || inner.TimeLimit != 100*time.Millisecond {
+		t.Fatalf("expected a budgeted searcher playing black, got %+v", inner)
+	}
+
+	// Always blundering still plays legal plies
+	g := core.NewGame()
+	blunderer := blunderingSearcher{Searcher: minimax.DepthLimitedSearcher{}, rate: 1}
+	for i := 0; i < 10 && !g.Result().Over(); i++ {
+		if _, err := g.DoPly(blunderer.Search(g)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFixedSearcher(t *testing.T) {
+	for _, d := range []searcherData{
+		{Heuristic: "WeightedCount", DepthLimit: -1},
+		{Heuristic: "WeightedCount", DepthLimit: maxDepthLimit + 1},
+		{Heuristic: "WeightedCount", NodeLimit: maxNodeLimit + 1},
+		{Heuristic: "WeightedCount", DepthLimit: 2, TimeLimitMs: 100},
+		{Level: "expert", DepthLimit: 2},
+	} {
+		if _, _, err := d.searcher(); err == nil {
+			t.Errorf("%+v should be invalid", d)
+		}
+	}
+
+	// Plays the best ply according to a search one ply shallower from
+	// each of the plies
+	h := minimax.WeightedCountHeuristic
+	g := core.NewGame()
+	for i := 0; i < 6; i++ {
+		toPlay := g.ToPlay()
+		ply := fixedSearcher{ToMax: toPlay, Heuristic: h, DepthLimit: 3}.Search(g.Copy())
+		best := math.Inf(-1)
+		var got float64
+		for _, p := range g.Plies() {
+			next := g.Copy()
+			if _, err := next.DoPly(p); err != nil {
+				t.Fatal(err)
+			}
+			v := evaluate(next, h, toPlay, 2)
+			best = math.Max(best, v)
+			if p.Equals(ply) {
+				got = v
+			}
+		}
+		if got != best {
+			t.Fatalf("ply %d: want value %v, got %v", i, best, got)
+		}
+		if _, err := g.DoPly(ply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Even a tiny budget gives a valid ply
+	if ply := (fixedSearcher{ToMax: core.WhiteColor, Heuristic: h, NodeLimit: 1}).Search(core.NewGame()); ply == nil {
+		t.Fatal("expected a ply")
+	}
+
+	// Same settings, same game
+	play := func() []core.Ply {
+		searcher, heuristic, err := searcherData{Heuristic: "WeightedCount", NodeLimit: 2000}.searcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := playMachineGame([2]machinePlayer{
+			whiteColor: newMachinePlayer(whiteColor, searcher, heuristic),
+			blackColor: newMachinePlayer(blackColor, searcher, heuristic),
+		}, gameOptions{idleTimeout: time.Minute})
+		return g.copyPlyHistory()
+	}
+	if !core.PliesEquals(play(), play()) {
+		t.Fatal("games with the same fixed searchers should be the same")
+	}
+}
+
+func TestSearcherWrappers(t *testing.T) {
+	h := minimax.WeightedCountHeuristic
+	var searcher minimax.Searcher = bookSearcher{
+		Searcher: blunderingSearcher{Searcher: minimax.TimeLimitedSearcher{Heuristic: h, TimeLimit: time.Second}},
+	}
+	searcher = budgeted(searcherFor(searcher, core.BlackColor), 200*time.Millisecond)
+
+	inner := searcher.(searcherWrapper).unwrap().(searcherWrapper).unwrap().(minimax.TimeLimitedSearcher)
+	if inner.ToMax != core.BlackColor || inner.TimeLimit != 200*time.Millisecond {
+		t.Fatalf("wrapped searcher wasn't set up, got %+v", inner)
+	}
+}
+
+func TestSearchCancellation(t *testing.T) {
+	// Counts the positions evaluated, to tell whether a search still runs
+	var evaluated atomic.Int64
+	h := func(b *core.Board, player core.Color) float64 {
+		evaluated.Add(1)
+		return minimax.WeightedCountHeuristic(b, player)
+	}
+	assertStopped := func(name string) {
+		t.Helper()
+		before := evaluated.Load()
+		time.Sleep(100 * time.Millisecond)
+		if after := evaluated.Load(); after != before {
+			t.Errorf("%s: search kept running after it returned, %d more positions evaluated", name, after-before)
+		}
+	}
+
+	searchers := []minimax.Searcher{
+		minimax.TimeLimitedSearcher{Heuristic: h, TimeLimit: minimax.MaxTimeLimit},
+		minimax.DepthLimitedSearcher{Heuristic: h, DepthLimit: maxDepthLimit},
+		fixedSearcher{Heuristic: h, NodeLimit: maxNodeLimit},
+		blunderingSearcher{Searcher: fixedSearcher{Heuristic: h, DepthLimit: maxDepthLimit}, rate: 0},
+	}
+	for _, s := range searchers {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		start := time.Now()
+		if _, err := searchContext(ctx, s, core.NewGame()); err == nil {
+			t.Errorf("%T: cancelled search should fail", s)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%T: cancelled search took %v", s, elapsed)
+		}
+	}
+
+	// Cancelled while searching
+	for _, s := range searchers {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		if _, err := searchContext(ctx, s, core.NewGame()); err == nil {
+			t.Errorf("%T: cancelled search should fail", s)
+		}
+		cancel()
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%T: cancelled search took %v", s, elapsed)
+		}
+		assertStopped(fmt.Sprintf("%T", s))
+	}
+
+	ply, err := searchContext(context.Background(), minimax.TimeLimitedSearcher{Heuristic: h, TimeLimit: 0}, core.NewGame())
+	if err != nil || ply == nil {
+		t.Fatalf("time-limited search should give a ply, got %v (%v)", ply, err)
+	}
+
+	// Resigning while the machine thinks stops it right away
+	g := newConGame(gameOptions{})
+	machine := newMachinePlayer(core.WhiteColor, minimax.TimeLimitedSearcher{Heuristic: h, TimeLimit: minimax.MaxTimeLimit}, h)
+	done := make(chan struct{})
+	go func() {
+		machine.run(g)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := g.resign(core.BlackColor); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("machine kept thinking after the game was over")
+	}
+	assertStopped("machine")
+}
+
+func TestSearchSlotHeldUntilStopped(t *testing.T) {
+	// Every position the machine evaluates must be evaluated while it holds
+	// a slot, even after the game is over
+	var outside atomic.Int64
+	h := func(b *core.Board, player core.Color) float64 {
+		scheduler.mu.Lock()
+		if scheduler.running == 0 {
+			outside.Add(1)
+		}
+		scheduler.mu.Unlock()
+		return minimax.WeightedCountHeuristic(b, player)
+	}
+
+	g := newConGame(gameOptions{})
+	machine := newMachinePlayer(core.WhiteColor, minimax.TimeLimitedSearcher{Heuristic: h, TimeLimit: minimax.MaxTimeLimit}, h)
+	done := make(chan struct{})
+	go func() {
+		machine.run(g)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := g.resign(core.BlackColor); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	time.Sleep(100 * time.Millisecond)
+	if n := outside.Load(); n > 0 {
+		t.Errorf("%d positions evaluated after the slot was freed", n)
+	}
+}
+
+func TestSearchScheduler(t *testing.T) {
+	workers := 1
+	s := newSearchScheduler(&workers)
+	a, b := newConGame(gameOptions{}), newConGame(gameOptions{})
+
+	release, err := s.acquire(context.Background(), a, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two searches from a, then one from b: b's goes second
+	var mu sync.Mutex
+	var served []string
+	ahead := make(map[string]int)
+	var wg sync.WaitGroup
+	wait := func(name string, g *conGame) {
+		defer wg.Done()
+		release, err := s.acquire(context.Background(), g, func(n int) {
+			ahead[name] = n
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		mu.Lock()
+		served = append(served, name)
+		mu.Unlock()
+		release()
+	}
+	queue := func(name string, g *conGame, depth int) {
+		wg.Add(1)
+		go wait(name, g)
+		for {
+			s.mu.Lock()
+			n := len(s.waiting[g])
+			s.mu.Unlock()
+			if n == depth {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	queue("a1", a, 1)
+	queue("a2", a, 2)
+	queue("b1", b, 1)
+
+	s.mu.Lock()
+	if ahead["a1"] != 0 || ahead["b1"] != 1 || ahead["a2"] != 2 {
+		t.Errorf("unexpected queue positions %v", ahead)
+	}
+	s.mu.Unlock()
+
+	// Giving up leaves the line
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := s.acquire(ctx, b, nil)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-done; err == nil {
+		t.Fatal("cancelled acquire should fail")
+	}
+
+	release()
+	wg.Wait()
+	if !slices.Equal(served, []string{"a1", "b1", "a2"}) {
+		t.Fatalf("want searches served a1, b1, a2, got %v", served)
+	}
+	if s.running != 0 || len(s.order) != 0 {
+		t.Fatalf("scheduler should be idle, running %d with %d games waiting", s.running, len(s.order))
+	}
+}
+
+func TestOpeningBook(t *testing.T) {
+	db := &memStore{}
+
+	start := core.NewGame()
+	white := start.Plies()[0]
+	other := start.Plies()[1]
+	after := start.Copy()
+	after.DoPly(white)
+	black := after.Plies()[0]
+
+	records := []gameRecord{
+		{Result: core.WhiteWonResult, Plies: []core.Ply{white, black}},
+		{Result: core.WhiteWonResult, Plies: []core.Ply{white, black}},
+		{Result: core.DrawResult, Plies: []core.Ply{white, black}},
+		// Played only once
+		{Result: core.WhiteWonResult, Plies: []core.Ply{other}},
+		// Not over
+		{Plies: []core.Ply{other}},
+	}
+	for i, record := range records {
+		mode := humanMode
+		if i%2 == 1 {
+			mode = machineMode
+		}
+		if err := saveGameRecord(db, mode, uuid.New(), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := buildBook(db, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The white ply did well, the black reply didn't win once but drew
+	want := openingBook{
+		positionKey(start): {{Ply: white, Weight: 5}},
+		positionKey(after): {{Ply: black, Weight: 1}},
+	}
+	if len(b) != len(want) {
+		t.Fatalf("want %d positions, got %d", len(want), len(b))
+	}
+	for key, moves := range want {
+		got := b[key]
+		if len(got) != 1 || !got[0].Ply.Equals(moves[0].Ply) || got[0].Weight != moves[0].Weight {
+			t.Fatalf("position %v: want %v, got %v", key, moves, got)
+		}
+	}
+
+	var buf strings.Builder
+	if err := json.NewEncoder(&buf).Encode(b); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readBook(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ply := read.choose(start.Copy()); !ply.Equals(white) {
+		t.Fatalf("want book ply %v, got %v", white, ply)
+	}
+	if ply := read.choose(core.NewCustomGame(stagnantTurnsToDraw(0), nil, core.BlackColor)); ply != nil {
+		t.Fatalf("position not in the book, got %v", ply)
+	}
+
+	// Weighted, illegal plies are never chosen
+	b = openingBook{positionKey(start): {
+		{Ply: white, Weight: 3},
+		{Ply: other, Weight: 1},
+		{Ply: black, Weight: 100},
+	}}
+	counts := make(map[bool]int)
+	for i := 0; i < 400; i++ {
+		ply := b.choose(start.Copy())
+		if !ply.Equals(white) && !ply.Equals(other) {
+			t.Fatalf("chose ply not in the book or illegal: %v", ply)
+		}
+		counts[ply.Equals(white)]++
+	}
+	if counts[true] < counts[false] {
+		t.Fatalf("heavier ply chosen less often: %v", counts)
+	}
+
+	old := book
+	book = b
+	defer func() { book = old }()
+
+	searcher, _, err := searcherData{Heuristic: "WeightedCount", DepthLimit: 2}.searcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := searcher.(bookSearcher); !ok {
+		t.Fatalf("expected the searcher to use the book, got %T", searcher)
+	}
+	ply, inner := bookPly(searcher, start.Copy())
+	if ply == nil {
+		t.Fatal("expected a book ply")
+	}
+	if _, ok := inner.(bookSearcher); ok {
+		t.Fatal("expected the searcher without the book")
+	}
+	if ply, err := searchContext(context.Background(), searcher, after.Copy()); err != nil || ply == nil {
+		t.Fatalf("expected a ply searched outside of the book, got %v (%v)", ply, err)
+	}
+
+	noBook := false
+	searcher, _, err = searcherData{Heuristic: "WeightedCount", DepthLimit: 2, Book: &noBook}.searcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ply, _ := bookPly(searcher, start.Copy()); ply != nil {
+		t.Fatal("book disabled but used anyway")
+	}
+}
+
+func TestEndgameTable(t *testing.T) {
+	if _, err := buildEndgameTable(maxEndgamePieces + 1); err == nil {
+		t.Fatal("expected error for too many pieces")
+	}
+	table, err := buildEndgameTable(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := t.TempDir() + "/endgames.gob"
+	if err := table.save(path); err != nil {
+		t.Fatal(err)
+	}
+	table, err = loadEndgameTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Checked against a search exactly as deep as the distance, which must
+	// find the same result, while one ply shallower must not
+	checked := 0
+	for key, d := range table.distances {
+		if checked == 200 {
+			break
+		}
+		if strings.Contains(key, "/") || d > 9 {
+			continue
+		}
+		toPlay := core.WhiteColor
+		if strings.HasPrefix(key, core.BlackColor.String()) {
+			toPlay = core.BlackColor
+		}
+		var board core.Board
+		if err := board.Unserialize([]byte(key[strings.Index(key, ":")+1:])); err != nil {
+			t.Fatal(err)
+		}
+		g := core.NewCustomGame(stagnantTurnsToDraw(0), &board, toPlay)
+
+		v, ok := table.probe(g, 0)
+		if !ok || v.winner == nil || v.plies != int(d) {
+			t.Fatalf("%v: probe gave %v, %v", key, v, ok)
+		}
+		want := float64(winValue)
+		if *v.winner != toPlay {
+			want = lossValue
+		}
+		if got := evaluate(g, hintHeuristic, toPlay, int(d)); got != want {
+			t.Fatalf("%v: table says %v in %d, search found %v", key, *v.winner, d, got)
+		}
+		if d > 0 && evaluate(g, hintHeuristic, toPlay, int(d)-1) == want {
+			t.Fatalf("%v: search found the result faster than in %d", key, d)
+		}
+
+		if d > 0 {
+			ply := table.bestPly(g, 0)
+			if ply == nil {
+				t.Fatalf("%v: no best ply", key)
+			}
+			g.DoPly(ply)
+			if after, ok := table.probe(g, nextSpecialPlies(g.Board(), 0)); ok && after.plies != int(d)-1 {
+				t.Fatalf("%v: best ply leads to %d plies, want %d", key, after.plies, d-1)
+			}
+		}
+		checked++
+	}
+	if checked == 0 {
+		t.Fatal("no decided positions checked")
+	}
+
+	// Special endings are covered, knowing how long they have gone on
+	kings := core.DecodeBoard(`
+		.@......
+		........
+		........
+		........
+		........
+		........
+		........
+		......#.`)
+	game := core.NewCustomGame(stagnantTurnsToDraw(0), kings, core.WhiteColor)
+	if _, ok := table.probe(game, 1); !ok {
+		t.Fatal("special ending should be covered")
+	}
+	// Nothing to capture right away, and the next ply ends the special ending
+	if v, ok := table.probe(game, specialEndingPlies-1); !ok || v.winner != nil {
+		t.Fatalf("special ending about to be drawn should be a draw, got %v, %v", v, ok)
+	}
+	cg := newConGame(gameOptions{start: &startPosition{board: *kings, toPlay: core.WhiteColor}})
+	if err := cg.doIndexPly(core.WhiteColor, cg.current().version, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, n := cg.positionCopy(); n != 2 {
+		t.Fatalf("the special ending should have lasted 2 plies, got %d", n)
+	}
+	if _, ok := table.probe(core.NewGame(), 0); ok {
+		t.Fatal("start position shouldn't be covered")
+	}
+	var none *endgameTable
+	if none.bestPly(core.NewGame(), 0) != nil {
+		t.Fatal("no table, but got a ply")
+	}
+}
+
+func TestThought(t *testing.T) {
+	g := core.NewGame()
+	searcher := fixedSearcher{ToMax: core.WhiteColor, Heuristic: minimax.WeightedCountHeuristic, DepthLimit: 4}
+	th := searcher.think(context.Background(), g, nil)
+	if th.score == nil || th.depth != 4 || th.nodes == 0 || len(th.pv) != 4 {
+		t.Fatalf("expected a full thought, got %+v", th)
+	}
+	if !th.pv[0].Equals(th.ply) || !th.ply.Equals(searcher.Search(g)) {
+		t.Fatal("principal variation doesn't start with the chosen ply")
+	}
+	game := g.Copy()
+	for i, ply := range th.pv {
+		if _, err := game.DoPly(ply); err != nil {
+			t.Fatalf("ply %d of the principal variation can't be played: %v", i, err)
+		}
+	}
+	if evaluate(g, minimax.WeightedCountHeuristic, core.WhiteColor, 4) != *th.score {
+		t.Fatalf("score %v doesn't match the evaluation", *th.score)
+	}
+
+	// Progress is reported while searching, with what the last finished
+	// iteration found
+	ctx, cancel := context.WithTimeout(context.Background(), 3*thoughtProgressInterval/2)
+	defer cancel()
+	var progress []thought
+	searcher = fixedSearcher{ToMax: core.WhiteColor, Heuristic: minimax.WeightedCountHeuristic}
+	final := searcher.think(ctx, g, func(t thought) {
+		progress = append(progress, t)
+	})
+	if len(progress) == 0 {
+		t.Fatal("no progress reported")
+	}
+	last := progress[len(progress)-1]
+	if last.depth == 0 || last.ply == nil || last.nodes > final.nodes || last.depth > final.depth {
+		t.Fatalf("unexpected progress %+v, final %+v", last, final)
+	}
+
+	// Without a search there's nothing to tell but the ply
+	b := openingBook{positionKey(g): {{Ply: g.Plies()[0], Weight: 1}}}
+	bookThought, err := think(context.Background(), bookSearcher{Searcher: searcher, book: b}, g, nil)
+	if err != nil || bookThought.source != bookSource || bookThought.score != nil {
+		t.Fatalf("unexpected book thought %+v (%v)", bookThought, err)
+	}
+}
+
+func TestPlyNotation(t *testing.T) {
+	if n := squareNumber(0, 1); n != 1 {
+		t.Fatalf("top left dark square should be 1, got %d", n)
+	}
+	if n := squareNumber(7, 6); n != 32 {
+		t.Fatalf("bottom right dark square should be 32, got %d", n)
+	}
+
+	g := newConGame(gameOptions{})
+	s := g.current()
+	want := []string{"21-17", "22-17", "22-18", "23-18", "23-19", "24-19", "24-20"}
+	if got := pliesNotation(s.plies); !slices.Equal(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for _, notation := range want {
+		ply, err := plyFromNotation(s.plies, " "+notation+" ")
+		if err != nil || plyNotation(ply) != notation {
+			t.Fatalf("%v: got %v (%v)", notation, ply, err)
+		}
+	}
+
+	for notation, message := range map[string]string{
+		"22":       "not like",
+		"22-18-15": "not like",
+		"a-b":      "not like",
+		"22-33":    "between 1 and 32",
+		"22-15":    "not legal",
+		"22x15":    "not legal",
+	} {
+		if _, err := plyFromNotation(s.plies, notation); err == nil || !strings.Contains(err.Error(), message) {
+			t.Fatalf("%v: expected an error saying %q, got %v", notation, message, err)
+		}
+	}
+
+	if err := g.doNotationPly(core.WhiteColor, s.version, "22-18"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.doNotationPly(core.BlackColor, s.version, "11-15"); err == nil {
+		t.Fatal("expected an error for a stale version")
+	}
+
+	// The pawn in the middle can go around the diamond either way
+	diamond := core.NewCustomGame(stagnantTurnsToDraw(0), core.DecodeBoard(`
+		........
+		.x.x....
+		........
+		.x.x....
+		..o.....
+		........
+		........
+		........`), core.WhiteColor)
+	plies := diamond.Plies()
+	for _, notation := range []string{"18x9x2x11x18", "18x11x2x9x18"} {
+		if ply, err := plyFromNotation(plies, notation); err != nil || plyNotation(ply) != notation {
+			t.Fatalf("%v: got %v (%v)", notation, ply, err)
+		}
+	}
+	if _, err := plyFromNotation(plies, "18x18"); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Fatalf("expected an ambiguity error, got %v", err)
+	}
+	if _, err := plyFromNotation(plies, "18-14"); err == nil || !strings.Contains(err.Error(), "capture is mandatory") {
+		t.Fatalf("expected an error about the mandatory capture, got %v", err)
+	}
+}
@@ -110,13 +110,32 @@ func gameKey(mode gameMode, id uuid.UUID) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func savePlyHistory(db store, mode gameMode, id uuid.UUID, history []core.Ply) error {
+// A gameRecord is what gets stored about a game once it's over
+type gameRecord struct {
+	Result core.GameResult `json:"result"`
+	Reason string          `json:"reason,omitempty"`
+	// Position the plies are played from, nil for the standard one
+	Start *startRecord `json:"start,omitempty"`
+	Plies []core.Ply   `json:"plies"`
+	// Player who stopped playing, if the game ended by abandonment
+	AbandonedBy *core.Color `json:"abandonedBy,omitempty"`
+	Chat        []chatLine  `json:"chat,omitempty"`
+	// Only stored when hints were allowed
+	Hints *hintsRecord `json:"hints,omitempty"`
+	// Id of the first game of the series, for rematches (the first game itself
+	// is stored without it)
+	Series *uuid.UUID `json:"series,omitempty"`
+	// Tournament the game was played in
+	Tournament *uuid.UUID `json:"tournament,omitempty"`
+}
+
+func saveGameRecord(db store, mode gameMode, id uuid.UUID, record gameRecord) error {
 	err := db.update(func(tx transaction) error {
 		key, err := gameKey(mode, id)
 		if err != nil {
 			return err
 		}
-		val, err := json.Marshal(history)
+		val, err := json.Marshal(record)
 		if err != nil {
 			return err
 		}
@@ -126,25 +145,34 @@ func savePlyHistory(db store, mode gameMode, id uuid.UUID, history []core.Ply) e
 		return nil
 	})
 	if err != nil {
-		log.Printf("failed to save game history (mode %v, id %v)", mode, id)
+		log.Printf("failed to save game record (mode %v, id %v)", mode, id)
 	}
 	return err
 }
 
-func getPlyHistory(db store, mode gameMode, id uuid.UUID) ([]core.Ply, error) {
-	var history []core.Ply
-	err := db.update(func(tx transaction) error {
+func getGameRecord(db store, mode gameMode, id uuid.UUID) (gameRecord, error) {
+	var record gameRecord
+	err := db.view(func(tx transaction) error {
 		key, err := gameKey(mode, id)
 		if err != nil {
 			return err
 		}
 		val := tx.get(key)
-		if err := json.Unmarshal(val, &history); err != nil {
+		// Games used to be stored as just the ply history
+		if len(val) > 0 && val[0] == '[' {
+			return json.Unmarshal(val, &record.Plies)
+		}
+		if err := json.Unmarshal(val, &record); err != nil {
 			return err
 		}
 		return nil
 	})
-	return history, err
+	return record, err
+}
+
+func getPlyHistory(db store, mode gameMode, id uuid.UUID) ([]core.Ply, error) {
+	record, err := getGameRecord(db, mode, id)
+	return record.Plies, err
 }
 
 func getGameIds(db store, mode gameMode) ([]uuid.UUID, error) {
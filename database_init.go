@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"slices"
+	"sync"
 
 	"github.com/boltdb/bolt"
 )
@@ -134,6 +135,8 @@ type memEntry struct {
 }
 
 type memStore struct {
+	// Transactions run one at a time, like bolt's writable ones
+	mu      sync.Mutex
 	entries []memEntry
 }
 
@@ -226,9 +229,13 @@ func (mc *memCursor) first() ([]byte, []byte) {
 }
 
 func (ms *memStore) update(fn func(transaction) error) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
 	return fn(ms)
 }
 
 func (ms *memStore) view(fn func(transaction) error) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
 	return fn(ms)
 }
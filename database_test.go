@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"slices"
 	"testing"
+
+	"github.com/google/uuid"
+	"github.com/luc527/go_checkers/core"
 )
 
 func TestWebhookStorage(t *testing.T) {
@@ -51,3 +55,71 @@ func TestWebhookStorage(t *testing.T) {
 		t.Fatal("failed to delete webhook")
 	}
 }
+
+func TestGameRecordStorage(t *testing.T) {
+	db := &memStore{}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start, err := startPositionFrom("54wp25bp70bk", core.BlackColor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := gameRecord{
+		Result: core.WhiteWonResult,
+		Reason: "resignation",
+		Start:  start.record(),
+		Plies:  generateRandomPlyHistory(),
+	}
+	if err := saveGameRecord(db, humanMode, id, want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := getGameRecord(db, humanMode, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Result != want.Result || got.Reason != want.Reason {
+		t.Fatalf("want %v (%q), got %v (%q)", want.Result, want.Reason, got.Result, got.Reason)
+	}
+	if !core.PliesEquals(got.Plies, want.Plies) {
+		t.Fatal("plies mismatch")
+	}
+	if got.Start == nil || !sameBoard(got.Start.Board, want.Start.Board) || got.Start.ToPlay != want.Start.ToPlay {
+		t.Fatal("start position mismatch")
+	}
+}
+
+func TestLegacyPlyHistory(t *testing.T) {
+	db := &memStore{}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history := generateRandomPlyHistory()
+	key, err := gameKey(machineMode, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := json.Marshal(history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.put(key, val); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := getPlyHistory(db, machineMode, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !core.PliesEquals(got, history) {
+		t.Fatal("failed to load ply history stored in the old format")
+	}
+}
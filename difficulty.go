@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/luc527/go_checkers/core"
+	"github.com/luc527/go_checkers/minimax"
+)
+
+// Engine settings behind a named difficulty level
+type difficulty struct {
+	heuristic minimax.Heuristic
+	// Depth limit, or zero to search for timeLimit instead
+	depth     int
+	timeLimit time.Duration
+	// Chance of playing a random ply instead of the one found by the search
+	blunderRate float64
+}
+
+// From weakest to strongest
+var difficultyLevels = []string{"beginner", "casual", "intermediate", "advanced", "expert"}
+
+var difficulties = map[string]difficulty{
+	"beginner": {
+		heuristic:   minimax.UnweightedCountHeuristic,
+		depth:       1,
+		blunderRate: 0.4,
+	},
+	"casual": {
+		heuristic:   minimax.UnweightedCountHeuristic,
+		depth:       2,
+		blunderRate: 0.2,
+	},
+	"intermediate": {
+		heuristic:   minimax.WeightedCountHeuristic,
+		depth:       4,
+		blunderRate: 0.08,
+	},
+	"advanced": {
+		heuristic:   minimax.WeightedCountHeuristic,
+		timeLimit:   1 * time.Second,
+		blunderRate: 0.02,
+	},
+	"expert": {
+		heuristic: minimax.WeightedCountHeuristic,
+		timeLimit: 3 * time.Second,
+	},
+}
+
+func difficultyFromString(level string) (difficulty, error) {
+	d, ok := difficulties[level]
+	if !ok {
+		return d, fmt.Errorf("unknown difficulty level %q, must be one of %v", level, difficultyLevels)
+	}
+	return d, nil
+}
+
+func (d difficulty) searcher() minimax.Searcher {
+	var searcher minimax.Searcher
+	if d.depth > 0 {
+		searcher = minimax.DepthLimitedSearcher{
+			Heuristic:  d.heuristic,
+			DepthLimit: d.depth,
+		}
+	} else {
+		searcher = minimax.TimeLimitedSearcher{
+			Heuristic: d.heuristic,
+			TimeLimit: d.timeLimit,
+		}
+	}
+	if d.blunderRate > 0 {
+		searcher = blunderingSearcher{Searcher: searcher, rate: d.blunderRate}
+	}
+	return searcher
+}
+
+// Every now and then plays a random ply instead of searching, so lower levels
+// make mistakes a stronger player can punish
+type blunderingSearcher struct {
+	minimax.Searcher
+	rate float64
+}
+
+func (s blunderingSearcher) Search(g *core.Game) core.Ply {
+	if ply := s.blunder(g); ply != nil {
+		return ply
+	}
+	return s.Searcher.Search(g)
+}
+
+func (s blunderingSearcher) pick(g *core.Game) (core.Ply, string) {
+	return s.blunder(g), blunderSource
+}
+
+func (s blunderingSearcher) unwrap() minimax.Searcher {
+	return s.Searcher
+}
+
+func (s blunderingSearcher) with(inner minimax.Searcher) minimax.Searcher {
+	s.Searcher = inner
+	return s
+}
+
+// A random ply every now and then, nil otherwise
+func (s blunderingSearcher) blunder(g *core.Game) core.Ply {
+	plies := g.Plies()
+	if len(plies) > 0 && rand.Float64() < s.rate {
+		return plies[rand.Intn(len(plies))]
+	}
+	return nil
+}
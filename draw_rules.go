@@ -0,0 +1,123 @@
+package main
+
+import (
+	"github.com/luc527/go_checkers/core"
+)
+
+const (
+	// How many times the same position must be reached for the game to be drawn
+	repetitionsToDraw = 3
+
+	repetitionReason = "repetition"
+	noProgressReason = "no progress"
+)
+
+// Keeps track of the positions a game went through, to apply the draw rules
+// core.Game doesn't know about
+type positionTracker struct {
+	// Position reached after each ply, starting with the initial one
+	positions []trackedPosition
+	counts    map[string]int
+}
+
+type trackedPosition struct {
+	key string
+	// Plies since the last capture or pawn move
+	sinceProgress int
+	// Positions the special ending has lasted, this one included, like core
+	// counts them; 0 when it's not one
+	specialPlies int
+}
+
+func newPositionTracker(game *core.Game) *positionTracker {
+	t := &positionTracker{counts: make(map[string]int)}
+	t.add(trackedPosition{
+		key:          positionKey(game),
+		specialPlies: nextSpecialPlies(game.Board(), 0),
+	})
+	return t
+}
+
+// Identifies the position by the pieces on the board and the player to move
+func positionKey(game *core.Game) string {
+	return boardKey(game.Board(), game.ToPlay())
+}
+
+func boardKey(board *core.Board, toPlay core.Color) string {
+	// Serializing only fails when writing to the buffer fails
+	bs, _ := board.Serialize()
+	return toPlay.String() + ":" + string(bs)
+}
+
+func (t *positionTracker) add(p trackedPosition) {
+	t.positions = append(t.positions, p)
+	t.counts[p.key]++
+}
+
+// Records the position reached by a ply, given the board before it
+func (t *positionTracker) push(before *core.Board, game *core.Game) {
+	last := t.positions[len(t.positions)-1]
+	p := trackedPosition{
+		key:          positionKey(game),
+		specialPlies: nextSpecialPlies(game.Board(), last.specialPlies),
+	}
+	// The player who made the ply is no longer the one to move
+	if !madeProgress(before, game.Board(), game.ToPlay().Opposite()) {
+		p.sinceProgress = last.sinceProgress + 1
+	}
+	t.add(p)
+}
+
+// How long the special ending of the current position has lasted, which the
+// endgame table needs to know
+func (t *positionTracker) specialPlies() int {
+	return t.positions[len(t.positions)-1].specialPlies
+}
+
+// Forgets the positions after the given number of plies
+func (t *positionTracker) truncate(plies int) {
+	for _, p := range t.positions[plies+1:] {
+		t.counts[p.key]--
+	}
+	t.positions = t.positions[:plies+1]
+}
+
+// Reason why the current position is a draw, empty if it isn't. Zero means
+// no limit of plies without progress.
+func (t *positionTracker) drawReason(noProgressLimit int) string {
+	last := t.positions[len(t.positions)-1]
+	if t.counts[last.key] >= repetitionsToDraw {
+		return repetitionReason
+	}
+	if noProgressLimit > 0 && last.sinceProgress >= noProgressLimit {
+		return noProgressReason
+	}
+	return ""
+}
+
+// Whether the ply between the two boards captured a piece or moved a pawn
+func madeProgress(before *core.Board, after *core.Board, mover core.Color) bool {
+	if pieceTotal(before.PieceCount()) != pieceTotal(after.PieceCount()) {
+		return true
+	}
+	return pawnSquares(before, mover) != pawnSquares(after, mover)
+}
+
+func pieceTotal(c core.PieceCount) int {
+	return int(c.WhitePawns) + int(c.BlackPawns) + int(c.WhiteKings) + int(c.BlackKings)
+}
+
+func pawnSquares(b *core.Board, color core.Color) uint64 {
+	var squares uint64
+	for row := byte(0); row < 8; row++ {
+		for col := byte(0); col < 8; col++ {
+			if !b.IsOccupied(row, col) {
+				continue
+			}
+			if c, k := b.Get(row, col); c == color && k == core.PawnKind {
+				squares |= 1 << (row*8 + col)
+			}
+		}
+	}
+	return squares
+}
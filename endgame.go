@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/luc527/go_checkers/core"
+)
+
+const (
+	defaultEndgamePieces = 3
+	// Solving 3 pieces already takes a few hundred MB, and the number of
+	// positions grows about 30 times with each piece
+	maxEndgamePieces = 3
+	// Plies core lets a special ending (e.g. two kings against one) go on
+	// before drawing the game
+	specialEndingPlies = 5
+	// Above any distance in the table
+	maxEndgameScore = math.MaxInt16 + 1
+)
+
+// Exact values of the positions with few pieces, found by retrograde
+// analysis. The values ignore the repetition and no-progress rules, which
+// depend on how the position was reached.
+type endgameTable struct {
+	pieces int
+	// Plies until the end of the game when both sides play the table's best
+	// plies, by position (see endgameKey). Odd when the player to move wins, even when they lose.
+	// Drawn positions aren't stored.
+	distances map[string]int16
+}
+
+// How the table is stored on disk
+type endgameFile struct {
+	Pieces    int
+	Distances map[string]int16
+}
+
+// Loaded at startup, nil if the server runs without one
+var endgames *endgameTable
+
+// Value of a position in the table, which ignores the repetition and
+// no-progress rules, so a game it says is won may still be drawn by them
+type endgameValue struct {
+	// nil for a draw
+	winner *core.Color
+	// Until the game is won, 0 for a draw
+	plies int
+}
+
+// Key of a position in the table. Positions in a special ending also need to
+// know for how many plies the ending has gone on, since core draws it after
+// a few.
+func endgameKey(board *core.Board, toPlay core.Color, specialPlies int) string {
+	key := boardKey(board, toPlay)
+	if specialPlies > 0 {
+		key += "/" + strconv.Itoa(specialPlies)
+	}
+	return key
+}
+
+// Same as core's rule: the endings where neither side has more than two
+// kings and one of them has only kings, at most two, and the other at most
+// one pawn
+func specialEnding(c core.PieceCount) bool {
+	return oneSidedSpecialEnding(c.WhiteKings, c.WhitePawns, c.BlackKings, c.BlackPawns) ||
+		oneSidedSpecialEnding(c.BlackKings, c.BlackPawns, c.WhiteKings, c.WhitePawns)
+}
+
+func oneSidedSpecialEnding(ourKings, ourPawns, theirKings, theirPawns int8) bool {
+	if ourPawns > 0 {
+		return false
+	}
+	switch ourKings {
+	case 2:
+		return (theirPawns == 0 && (theirKings == 1 || theirKings == 2)) || (theirPawns == 1 && theirKings == 1)
+	case 1:
+		return theirKings == 1 && theirPawns <= 1
+	default:
+		return false
+	}
+}
+
+// How long the special ending has lasted once the board is reached, given how
+// long it had lasted before
+func nextSpecialPlies(board *core.Board, specialPlies int) int {
+	if !specialEnding(board.PieceCount()) {
+		return 0
+	}
+	return specialPlies + 1
+}
+
+func colorCount(c core.PieceCount, color core.Color) int {
+	if color == core.WhiteColor {
+		return int(c.WhitePawns + c.WhiteKings)
+	}
+	return int(c.BlackPawns + c.BlackKings)
+}
+
+func (t *endgameTable) covers(board *core.Board) bool {
+	return t != nil && pieceTotal(board.PieceCount()) <= t.pieces
+}
+
+// Value for the player to move in the position, knowing for how many plies a
+// special ending has gone on (0 if it's not one). Only valid for positions
+// the table covers.
+func (t *endgameTable) distance(board *core.Board, toPlay core.Color, specialPlies int) (int, bool) {
+	count := board.PieceCount()
+	if colorCount(count, toPlay) == 0 {
+		return 0, true
+	}
+	if colorCount(count, toPlay.Opposite()) == 0 {
+		// Can't happen in a game, which is already over
+		return 0, false
+	}
+	d, ok := t.distances[endgameKey(board, toPlay, specialPlies)]
+	return int(d), ok
+}
+
+// Value of the game, if the table covers it, knowing for how many plies a
+// special ending has gone on (see positionTracker)
+func (t *endgameTable) probe(g *core.Game, specialPlies int) (endgameValue, bool) {
+	board := g.Board()
+	if !t.covers(board) {
+		return endgameValue{}, false
+	}
+	d, ok := t.distance(board, g.ToPlay(), specialPlies)
+	if !ok {
+		return endgameValue{}, true
+	}
+	winner := g.ToPlay()
+	if d%2 == 0 {
+		winner = winner.Opposite()
+	}
+	return endgameValue{winner: &winner, plies: d}, true
+}
+
+// Best ply in the position, nil if the table doesn't cover it. Wins as fast
+// as it can and loses as slowly as it can.
+func (t *endgameTable) bestPly(g *core.Game, specialPlies int) core.Ply {
+	if _, ok := t.probe(g, specialPlies); !ok {
+		return nil
+	}
+
+	var best core.Ply
+	bestScore := 0
+	for _, ply := range g.Plies() {
+		board := *g.Board()
+		if err := core.PerformInstructions(&board, ply); err != nil {
+			continue
+		}
+		score := 0
+		if d, ok := t.distance(&board, g.ToPlay().Opposite(), nextSpecialPlies(&board, specialPlies)); ok {
+			score = scoreAfter(d)
+		}
+		if best == nil || score > bestScore {
+			best, bestScore = ply, score
+		}
+	}
+	return best
+}
+
+// Orders the plies by how good they are for the player who did them, given
+// the value of the position they lead to for the opponent: wins first, the
+// faster the better, then draws, then losses, the slower the better
+func scoreAfter(opponentDistance int) int {
+	if opponentDistance%2 == 0 {
+		return maxEndgameScore - opponentDistance
+	}
+	return -maxEndgameScore + opponentDistance
+}
+
+// A position being solved
+type endgameState struct {
+	board        core.Board
+	toPlay       core.Color
+	specialPlies int
+	// Positions reached by each ply that have the same number of pieces
+	next []int32
+	// The plies leading to positions already solved (with fewer pieces, or
+	// where the game is over) are summarized: the fastest loss for the
+	// opponent, the slowest win for the opponent, and whether they all are
+	// wins for the opponent
+	fastestLoss int
+	slowestWin  int
+	allWins     bool
+}
+
+// Solves the positions with up to the given number of pieces
+func buildEndgameTable(pieces int) (*endgameTable, error) {
+	if pieces < 2 || pieces > maxEndgamePieces {
+		return nil, fmt.Errorf("endgame table: pieces must be between 2 and %d", maxEndgamePieces)
+	}
+	t := &endgameTable{distances: make(map[string]int16)}
+	for n := 2; n <= pieces; n++ {
+		t.solve(n)
+		t.pieces = n
+	}
+	return t, nil
+}
+
+// Solves the positions with exactly n pieces, once the ones with fewer are
+// solved. Starting from the positions where the player to move has lost, each
+// pass finds the positions won or lost in one more ply, until no more are
+// found; the rest are draws.
+func (t *endgameTable) solve(n int) {
+	longest := 0
+	for _, d := range t.distances {
+		longest = max(longest, int(d))
+	}
+
+	var states []endgameState
+	index := make(map[string]int32)
+	forEachBoard(n, func(board core.Board) {
+		specialPlies := []int{0}
+		if specialEnding(board.PieceCount()) {
+			specialPlies = []int{1, 2, 3, 4}
+		}
+		for _, toPlay := range []core.Color{core.WhiteColor, core.BlackColor} {
+			for _, sp := range specialPlies {
+				index[endgameKey(&board, toPlay, sp)] = int32(len(states))
+				states = append(states, endgameState{board: board, toPlay: toPlay, specialPlies: sp})
+			}
+		}
+	})
+
+	distances := make([]int, len(states))
+	for i := range states {
+		distances[i] = -1
+		s := &states[i]
+		s.fastestLoss, s.slowestWin, s.allWins = -1, -1, true
+
+		plies := core.GeneratePlies(nil, &s.board, s.toPlay)
+		if len(plies) == 0 {
+			distances[i] = 0
+			continue
+		}
+		for _, ply := range plies {
+			board := s.board
+			if err := core.PerformInstructions(&board, ply); err != nil {
+				continue
+			}
+			count := board.PieceCount()
+			specialPlies := 0
+			if specialEnding(count) {
+				specialPlies = s.specialPlies + 1
+			}
+			opponent := s.toPlay.Opposite()
+			if specialPlies == specialEndingPlies && colorCount(count, opponent) > 0 {
+				s.allWins = false
+				continue
+			}
+			if pieceTotal(count) == n {
+				if j, ok := index[endgameKey(&board, opponent, specialPlies)]; ok {
+					s.next = append(s.next, j)
+				} else {
+					s.allWins = false
+				}
+				continue
+			}
+			d, ok := t.distance(&board, opponent, specialPlies)
+			switch {
+			case !ok:
+				s.allWins = false
+			case d%2 == 0:
+				if s.fastestLoss < 0 || d < s.fastestLoss {
+					s.fastestLoss = d
+				}
+				s.allWins = false
+			default:
+				s.slowestWin = max(s.slowestWin, d)
+			}
+		}
+	}
+
+	quiet := 0
+	for d := 1; quiet < 2 || d <= longest+2; d++ {
+		found := false
+		for i := range states {
+			if distances[i] >= 0 {
+				continue
+			}
+			s := &states[i]
+			if d%2 == 1 && s.wonIn(d, distances) || d%2 == 0 && s.lostIn(d, distances) {
+				distances[i] = d
+				found = true
+			}
+		}
+		if found {
+			quiet = 0
+		} else {
+			quiet++
+		}
+	}
+
+	for i, s := range states {
+		if distances[i] >= 0 {
+			t.distances[endgameKey(&s.board, s.toPlay, s.specialPlies)] = int16(distances[i])
+		}
+	}
+}
+
+// Whether some ply leads to a position the opponent loses in d-1 plies
+func (s *endgameState) wonIn(d int, distances []int) bool {
+	if s.fastestLoss == d-1 {
+		return true
+	}
+	for _, j := range s.next {
+		if distances[j] == d-1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether every ply leads to a position the opponent wins, the slowest in
+// d-1 plies
+func (s *endgameState) lostIn(d int, distances []int) bool {
+	if !s.allWins {
+		return false
+	}
+	slowest := s.slowestWin
+	for _, j := range s.next {
+		if distances[j] < 0 || distances[j]%2 == 0 {
+			return false
+		}
+		slowest = max(slowest, distances[j])
+	}
+	return slowest == d-1
+}
+
+// Calls f with every legal board with n pieces of both colors
+func forEachBoard(n int, f func(core.Board)) {
+	var squares [][2]byte
+	for row := byte(0); row < 8; row++ {
+		for col := byte(0); col < 8; col++ {
+			if core.TileColor(row, col) == core.BlackColor {
+				squares = append(squares, [2]byte{row, col})
+			}
+		}
+	}
+
+	pieces := []struct {
+		color core.Color
+		kind  core.Kind
+	}{
+		{core.WhiteColor, core.PawnKind},
+		{core.WhiteColor, core.KingKind},
+		{core.BlackColor, core.PawnKind},
+		{core.BlackColor, core.KingKind},
+	}
+
+	var place func(board core.Board, from int, left int, colors [2]bool)
+	place = func(board core.Board, from int, left int, colors [2]bool) {
+		if left == 0 {
+			if colors[core.WhiteColor] && colors[core.BlackColor] {
+				f(board)
+			}
+			return
+		}
+		for i := from; i <= len(squares)-left; i++ {
+			row, col := squares[i][0], squares[i][1]
+			for _, p := range pieces {
+				if p.kind == core.PawnKind && row == crowningRow(p.color) {
+					continue
+				}
+				next := board
+				next.Set(row, col, p.color, p.kind)
+				withColor := colors
+				withColor[p.color] = true
+				place(next, i+1, left-1, withColor)
+			}
+		}
+	}
+	place(core.Board{}, 0, n, [2]bool{})
+}
+
+func loadEndgameTable(path string) (*endgameTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file endgameFile
+	if err := gob.NewDecoder(f).Decode(&file); err != nil {
+		return nil, fmt.Errorf("read endgame table: %v", err)
+	}
+	if file.Pieces < 2 || file.Pieces > maxEndgamePieces {
+		return nil, errors.New("read endgame table: invalid piece count")
+	}
+	return &endgameTable{pieces: file.Pieces, distances: file.Distances}, nil
+}
+
+func (t *endgameTable) save(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return gob.NewEncoder(f).Encode(endgameFile{Pieces: t.pieces, Distances: t.distances})
+}
+
+// Solves the endgames and writes the table to a file
+func runEndgameCommand(args []string) {
+	fs := flag.NewFlagSet("endgame", flag.ExitOnError)
+	out := fs.String("o", "endgames.gob", "file to write the table to")
+	pieces := fs.Int("pieces", defaultEndgamePieces, fmt.Sprintf("solve the positions with up to this many pieces (at most %d)", maxEndgamePieces))
+	fs.Parse(args)
+
+	t, err := buildEndgameTable(*pieces)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := t.save(*out); err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("wrote endgame table with %d decided positions to %v", len(t.distances), *out)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/luc527/go_checkers/core"
+	"github.com/luc527/go_checkers/minimax"
+)
+
+const (
+	drawValue = 0
+	winValue  = +1_000_000
+	lossValue = -1_000_000
+
+	defaultEvaluationDepth = 4
+	// Deeper searches would take too long to keep up with the game
+	maxEvaluationDepth = 6
+)
+
+// Settings for the evaluation attached to the state messages
+type liveEvaluation struct {
+	heuristic minimax.Heuristic
+	depth     int
+}
+
+func (d evaluationData) liveEvaluation() (*liveEvaluation, error) {
+	heuristic := minimax.WeightedCountHeuristic
+	if d.Heuristic != "" {
+		heuristic = minimax.HeuristicFromString(d.Heuristic)
+		if heuristic == nil {
+			return nil, fmt.Errorf("evaluation: unknown heuristic %v", d.Heuristic)
+		}
+	}
+	depth := defaultEvaluationDepth
+	if d.Depth != 0 {
+		depth = d.Depth
+	}
+	if depth < 1 || depth > maxEvaluationDepth {
+		return nil, fmt.Errorf("evaluation: depth must be between 1 and %d", maxEvaluationDepth)
+	}
+	return &liveEvaluation{heuristic: heuristic, depth: depth}, nil
+}
+
+// Evaluates the current position in the background, so state changes are
+// published without waiting for it. The state is published again once the
+// evaluation is done, unless it changed in the meantime.
+// Must be called with gameMu held.
+func (g *conGame) evaluateInner() {
+	e := g.opts.evaluation
+	if e == nil || g.state.result.Over() {
+		return
+	}
+	if v, ok := endgames.probe(g.game, g.positions.specialPlies()); ok {
+		g.state.endgame = &v
+	}
+	version := g.state.version
+	game := g.game.Copy()
+	go func() {
+		// Waits for its turn like the machine's searches, so evaluating games
+		// don't slow down everyone's machine opponents
+		release, err := scheduler.acquire(g.ctx, g, nil)
+		if err != nil {
+			return
+		}
+		defer release()
+		if g.current().version != version {
+			// Superseded while waiting
+			return
+		}
+		// From white's point of view, like an evaluation bar
+		value := evaluate(game, e.heuristic, whiteColor, e.depth)
+
+		g.gameMu.Lock()
+		defer g.gameMu.Unlock()
+		if g.state.version != version || g.state.result.Over() {
+			return
+		}
+		g.state.evaluation = &value
+		g.publish(g.state)
+	}()
+}
+
+// Searches the game tree up to the given depth and returns the value of the
+// game from the point of view of the given player, scoring the leaves with
+// the heuristic. The game is left as it was given.
+func evaluate(g *core.Game, h minimax.Heuristic, player core.Color, depth int) float64 {
+	search := &fixedSearch{
+		fixedSearcher: fixedSearcher{ToMax: player, Heuristic: h, DepthLimit: depth},
+		ctx:           context.Background(),
+	}
+	return search.search(g, 0, depth, math.Inf(-1), math.Inf(1))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+var (
+	exhibitionMu    = sync.Mutex{}
+	exhibitionGames = make(map[uuid.UUID]*exhibitionGame)
+)
+
+// A game where the machine plays both sides, for spectators to watch
+type exhibitionGame struct {
+	id uuid.UUID
+	*conGame
+	players [2]machinePlayer
+}
+
+func newExhibitionGame(white machinePlayer, black machinePlayer, opts gameOptions) (*exhibitionGame, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	spectatorToken, err := spectatorTokenFor(opts)
+	if err != nil {
+		return nil, err
+	}
+	eg := &exhibitionGame{
+		id:      id,
+		conGame: newConGame(opts),
+		players: [2]machinePlayer{
+			whiteColor: white,
+			blackColor: black,
+		},
+	}
+	eg.spectatorToken = spectatorToken
+	return eg, nil
+}
+
+func registerExhibitionGame(eg *exhibitionGame) {
+	exhibitionMu.Lock()
+	exhibitionGames[eg.id] = eg
+	exhibitionMu.Unlock()
+
+	go monitorGame(exhibitionMode, eg.conGame, eg.id, exhibitionGames, &exhibitionMu)
+
+	for _, p := range eg.players {
+		go p.run(eg.conGame)
+	}
+}
+
+func (c *client) startExhibitionGame(data exhibitionNewData) {
+	wsearcher, wheuristic, err := data.White.searcher()
+	if err != nil {
+		c.errorf("white: %v", err)
+		return
+	}
+	bsearcher, bheuristic, err := data.Black.searcher()
+	if err != nil {
+		c.errorf("black: %v", err)
+		return
+	}
+
+	opts, err := data.options()
+	if err != nil {
+		c.err(err)
+		return
+	}
+
+	white := newMachinePlayer(whiteColor, wsearcher, wheuristic)
+	black := newMachinePlayer(blackColor, bsearcher, bheuristic)
+	eg, err := newExhibitionGame(white, black, opts)
+	if err != nil {
+		c.err(err)
+		return
+	}
+
+	registerExhibitionGame(eg)
+
+	c.trySend(exhibitionCreatedMessageFrom(eg.id, eg.spectatorToken))
+	c.spectate(eg.conGame)
+}
+
+func (c *client) watchExhibitionGame(data watchData) {
+	exhibitionMu.Lock()
+	eg := exhibitionGames[data.Id]
+	exhibitionMu.Unlock()
+
+	if eg == nil {
+		c.errorf("exhibition game not found (id %v)", data.Id)
+		return
+	}
+	if err := eg.validateSpectatorToken(data.Token); err != nil {
+		c.err(err)
+		return
+	}
+
+	c.trySend(watchingMessageFrom("exhibition/watching", eg.id))
+	c.spectate(eg.conGame)
+}
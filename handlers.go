@@ -13,6 +13,9 @@ import (
 type jsonGameState struct {
 	Board   core.Board `json:"board"`
 	PlyDone core.Ply   `json:"plyDone"`
+	// Value of the position in the endgame table, when the server has one
+	// that covers it
+	Endgame *endgameInfo `json:"endgame,omitempty"`
 }
 
 var webhooksTemplate = template.Must(template.New("all").Parse(`
@@ -150,22 +153,38 @@ func handleGetGame(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	plyHistory, err := getPlyHistory(db, mode, id)
+	record, err := getGameRecord(db, mode, id)
 	if err != nil {
 		writeJsonError(w, http.StatusInternalServerError, "failed to load game history from the database")
 		return
 	}
+	plyHistory := record.Plies
 
-	board := new(core.Board)
-	core.PlaceInitialPieces(board)
+	toPlay := core.WhiteColor
+	if record.Start != nil {
+		toPlay = record.Start.ToPlay
+	}
+	game := core.NewCustomGame(stagnantTurnsToDraw(0), record.Start.initialBoard(), toPlay)
+	specialPlies := nextSpecialPlies(game.Board(), 0)
 
 	states := make([]jsonGameState, 0, 1+len(plyHistory))
 
-	for _, ply := range plyHistory {
-		states = append(states, jsonGameState{*board, ply})
-		core.PerformInstructions(board, ply)
+	stateOf := func(ply core.Ply) jsonGameState {
+		state := jsonGameState{Board: *game.Board(), PlyDone: ply}
+		if v, ok := endgames.probe(game, specialPlies); ok {
+			state.Endgame = endgameInfoFrom(&v)
+		}
+		return state
 	}
-	states = append(states, jsonGameState{*board, nil})
+	for _, ply := range plyHistory {
+		states = append(states, stateOf(ply))
+		if _, err := game.DoPly(ply); err != nil {
+			writeJsonError(w, http.StatusInternalServerError, "stored game has an invalid ply")
+			return
+		}
+		specialPlies = nextSpecialPlies(game.Board(), specialPlies)
+	}
+	states = append(states, stateOf(nil))
 
 	bytes, err := json.Marshal(states)
 	if err != nil {
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/luc527/go_checkers/core"
+	"github.com/luc527/go_checkers/minimax"
+)
+
+const hintTimeLimit = 500 * time.Millisecond
+
+var hintHeuristic = minimax.WeightedCountHeuristic
+
+// Ply the engine suggests to the player to move
+type hint struct {
+	// Version of the state the ply index refers to
+	version int
+	index   int
+	// Value of the game after the ply, from the player's point of view, as
+	// far as the engine could search in hintTimeLimit
+	value float64
+	// Hints the player has used so far, this one included
+	used int
+	// Exact result after the ply, nil when the endgame table doesn't cover it
+	endgame *endgameValue
+}
+
+// How many hints each player used, stored with the game
+type hintsRecord struct {
+	White int `json:"white"`
+	Black int `json:"black"`
+}
+
+// Must be called with gameMu held
+func (g *conGame) validateHint(player core.Color) error {
+	if !g.opts.hints {
+		return errors.New("hint: not allowed in this game")
+	}
+	if g.state.result.Over() {
+		return errors.New("hint: game already over")
+	}
+	if g.state.toPlay != player {
+		return errors.New("hint: not your turn")
+	}
+	if g.hintSearching[player] {
+		return errors.New("hint: still searching for the last one")
+	}
+	return nil
+}
+
+// Searches for the best ply in the current position
+func (g *conGame) hint(player core.Color) (hint, error) {
+	search, err := g.startHint(player)
+	if err != nil {
+		return hint{}, err
+	}
+	return search()
+}
+
+// Checks that the player can have a hint, and returns the search for it, to
+// be run without holding gameMu. Only one search per player runs at a time.
+func (g *conGame) startHint(player core.Color) (func() (hint, error), error) {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+	if err := g.validateHint(player); err != nil {
+		return nil, err
+	}
+	g.hintSearching[player] = true
+	s := g.state
+	game := g.game.Copy()
+	specialPlies := g.positions.specialPlies()
+
+	return func() (hint, error) {
+		h, err := g.searchHint(player, s, game, specialPlies)
+
+		g.gameMu.Lock()
+		defer g.gameMu.Unlock()
+		g.hintSearching[player] = false
+		if err != nil {
+			return hint{}, err
+		}
+		g.hintsUsed[player]++
+		h.used = g.hintsUsed[player]
+		return h, nil
+	}, nil
+}
+
+func (g *conGame) searchHint(player core.Color, s gameState, game *core.Game, specialPlies int) (hint, error) {
+	var t thought
+	if ply := endgames.bestPly(game, specialPlies); ply != nil {
+		t.ply = ply
+	} else {
+		release, err := scheduler.acquire(g.ctx, g, nil)
+		if err != nil {
+			return hint{}, errors.New("hint: game already over")
+		}
+		ctx, cancel := context.WithTimeout(g.ctx, hintTimeLimit)
+		searcher := fixedSearcher{ToMax: player, Heuristic: hintHeuristic}
+		t = searcher.think(ctx, game, nil)
+		cancel()
+		release()
+		if g.ctx.Err() != nil {
+			return hint{}, errors.New("hint: game already over")
+		}
+	}
+
+	index := slices.IndexFunc(s.plies, t.ply.Equals)
+	if index < 0 {
+		return hint{}, errors.New("hint: engine found no ply")
+	}
+	if _, err := game.DoPly(t.ply); err != nil {
+		return hint{}, fmt.Errorf("hint: %v", err)
+	}
+	h := hint{version: s.version, index: index}
+	if v, ok := endgames.probe(game, nextSpecialPlies(game.Board(), specialPlies)); ok {
+		h.endgame = &v
+		h.value = drawValue
+		if v.winner != nil && *v.winner == player {
+			h.value = winValue
+		} else if v.winner != nil {
+			h.value = lossValue
+		}
+	} else if t.score != nil {
+		h.value = *t.score
+	} else {
+		// The search ran out of time before finishing its first iteration
+		h.value = evaluate(game, hintHeuristic, player, 1)
+	}
+	return h, nil
+}
+
+// Must be called with gameMu held
+func (g *conGame) hintsRecordInner() *hintsRecord {
+	if !g.opts.hints {
+		return nil
+	}
+	return &hintsRecord{
+		White: g.hintsUsed[core.WhiteColor],
+		Black: g.hintsUsed[core.BlackColor],
+	}
+}
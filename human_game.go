@@ -4,7 +4,6 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"sync"
-	"time"
 
 	"github.com/google/uuid"
 	"github.com/luc527/go_checkers/core"
@@ -34,59 +33,99 @@ func genToken() (string, error) {
 	return hex.EncodeToString(bs), nil
 }
 
-func newHumanGame() (*humanGame, error) {
+func newHumanGame(opts gameOptions) (*humanGame, error) {
 	id, err := uuid.NewRandom()
 	if err != nil {
 		return nil, err
 	}
+	spectatorToken, err := spectatorTokenFor(opts)
+	if err != nil {
+		return nil, err
+	}
 	hg := &humanGame{
 		id:      id,
-		conGame: newConGame(),
+		conGame: newConGame(opts),
 		tokens: [2]string{
 			whiteColor: "",
 			blackColor: "",
 		},
 	}
+	hg.spectatorToken = spectatorToken
+	hg.newRematch = hg.rematch
 	return hg, nil
 }
 
-func (c *client) startHumanGame(data humanNewData) {
-	color := data.Color
-
-	hg, err := newHumanGame()
+// Creates the next game of the series, with the colors swapped. Must be called
+// with gameMu held.
+func (hg *humanGame) rematch() (*rematch, error) {
+	next, err := newHumanGame(hg.opts)
 	if err != nil {
-		c.err(err)
-		return
+		return nil, err
+	}
+	next.series = hg.seriesOf(hg.id)
+	if err := registerHumanGame(next); err != nil {
+		return nil, err
 	}
+	return &rematch{
+		id:     next.id,
+		series: next.series,
+		join: func(c *client, previous core.Color) {
+			c.joinHumanGame(next, previous.Opposite())
+		},
+	}, nil
+}
 
+// Gives the game its player tokens and makes it available for connections
+func registerHumanGame(hg *humanGame) error {
 	whiteToken, err := genToken()
 	if err != nil {
-		c.err(err)
-		return
+		return err
 	}
 	blackToken, err := genToken()
 	if err != nil {
-		c.err(err)
-		return
+		return err
 	}
 
+	hg.tokens[whiteColor] = whiteToken
+	hg.tokens[blackColor] = blackToken
+
 	humanMu.Lock()
 	humanGames[hg.id] = hg
 	humanMu.Unlock()
 
-	go monitorGame(humanMode, hg.conGame, hg.id, 2*time.Minute, humanGames, &humanMu)
+	go monitorGame(humanMode, hg.conGame, hg.id, humanGames, &humanMu)
+	return nil
+}
+
+func (c *client) startHumanGame(data humanNewData) {
+	color := data.Color
 
-	hg.tokens[whiteColor] = whiteToken
-	hg.tokens[blackColor] = blackToken
+	opts, err := data.options()
+	if err != nil {
+		c.err(err)
+		return
+	}
+
+	hg, err := newHumanGame(opts)
+	if err != nil {
+		c.err(err)
+		return
+	}
 
-	c.trySend(humanCreatedMessageFrom(color, hg.id, hg.tokens[color], hg.tokens[color.Opposite()]))
-	c.trySend(gameStateMessageFrom(hg.conGame.current(), color))
+	if err := registerHumanGame(hg); err != nil {
+		c.err(err)
+		return
+	}
+	if data.Open {
+		openChallenge(hg, color)
+	}
 
-	states := hg.conGame.channel()
-	go c.consumeGameStates(color, states)
+	c.trySend(humanCreatedMessageFrom(color, hg.id, hg.tokens[color], hg.tokens[color.Opposite()], hg.spectatorToken))
 
-	c.runPlayer(color, hg.conGame)
-	hg.detach(states)
+	c.play(color, hg.conGame)
+	if data.Open {
+		closeChallenge(hg, color)
+	}
 }
 
 func (c *client) connectToHumanGame(data humanConnectData) {
@@ -109,12 +148,31 @@ func (c *client) connectToHumanGame(data humanConnectData) {
 		return
 	}
 
-	c.trySend(humanConnectedMessageFrom(color, data.Id, data.Token))
-	c.trySend(gameStateMessageFrom(hg.conGame.current(), color))
+	c.joinHumanGame(hg, color)
+}
+
+func (c *client) joinHumanGame(hg *humanGame, color core.Color) {
+	challengeJoined(hg.id, color)
 
-	states := hg.conGame.channel()
-	go c.consumeGameStates(color, states)
+	c.trySend(humanConnectedMessageFrom(color, hg.id, hg.tokens[color], hg.spectatorToken))
+
+	c.play(color, hg.conGame)
+}
+
+func (c *client) watchHumanGame(data watchData) {
+	humanMu.Lock()
+	hg := humanGames[data.Id]
+	humanMu.Unlock()
+
+	if hg == nil {
+		c.errorf("human game not found (id %v)", data.Id)
+		return
+	}
+	if err := hg.validateSpectatorToken(data.Token); err != nil {
+		c.err(err)
+		return
+	}
 
-	c.runPlayer(color, hg.conGame)
-	hg.detach(states)
+	c.trySend(watchingMessageFrom("human/watching", hg.id))
+	c.spectate(hg.conGame)
 }
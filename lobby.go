@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/luc527/go_checkers/core"
+)
+
+// How many lobby events can be waiting to be sent to a subscriber before it's
+// dropped for falling behind
+const lobbyBufferSize = 32
+
+// A human game waiting for anyone to join as the opponent
+type challenge struct {
+	Id uuid.UUID `json:"id"`
+	// Color of whoever accepts the challenge
+	Color       core.Color       `json:"color"`
+	TimeControl *timeControlData `json:"timeControl,omitempty"`
+	CreatedAt   time.Time        `json:"createdAt"`
+}
+
+var (
+	lobbyMu          sync.Mutex
+	challenges       []challenge
+	lobbySubscribers = make(map[chan any]struct{})
+)
+
+// Must be called with lobbyMu held
+func notifyLobby(ev any) {
+	for c := range lobbySubscribers {
+		select {
+		case c <- ev:
+		default:
+			delete(lobbySubscribers, c)
+			close(c)
+		}
+	}
+}
+
+func openChallenge(hg *humanGame, creator core.Color) {
+	ch := challenge{
+		Id:          hg.id,
+		Color:       creator.Opposite(),
+		TimeControl: timeControlDataFrom(hg.opts.timeControl),
+		CreatedAt:   time.Now(),
+	}
+
+	lobbyMu.Lock()
+	defer lobbyMu.Unlock()
+	challenges = append(challenges, ch)
+	notifyLobby(challengeAddedMessageFrom(ch))
+}
+
+// Takes the first challenge that matches out of the lobby, returns false if
+// there was none
+func removeChallengeWhere(match func(challenge) bool) (challenge, bool) {
+	lobbyMu.Lock()
+	defer lobbyMu.Unlock()
+	i := slices.IndexFunc(challenges, match)
+	if i < 0 {
+		return challenge{}, false
+	}
+	ch := challenges[i]
+	challenges = slices.Delete(challenges, i, i+1)
+	notifyLobby(challengeRemovedMessageFrom(ch.Id))
+	return ch, true
+}
+
+func removeChallenge(id uuid.UUID) (challenge, bool) {
+	return removeChallengeWhere(func(ch challenge) bool {
+		return ch.Id == id
+	})
+}
+
+// The challenge is over once its opponent joins, be it through the lobby or
+// through the token
+func challengeJoined(id uuid.UUID, color core.Color) {
+	removeChallengeWhere(func(ch challenge) bool {
+		return ch.Id == id && ch.Color == color
+	})
+}
+
+// Nobody is left to play against once the creator disconnects, so the
+// challenge leaves the lobby
+func closeChallenge(hg *humanGame, creator core.Color) {
+	if hg.playerPresence(creator).connections > 0 {
+		return
+	}
+	challengeJoined(hg.id, creator.Opposite())
+}
+
+func openChallenges() []challenge {
+	lobbyMu.Lock()
+	defer lobbyMu.Unlock()
+	return append([]challenge{}, challenges...)
+}
+
+// Subscribes to the lobby, returning the challenges open at the time so no
+// event is missed between listing and subscribing
+func subscribeLobby() (chan any, []challenge) {
+	lobbyMu.Lock()
+	defer lobbyMu.Unlock()
+	c := make(chan any, lobbyBufferSize)
+	lobbySubscribers[c] = struct{}{}
+	return c, append([]challenge{}, challenges...)
+}
+
+func unsubscribeLobby(c chan any) {
+	lobbyMu.Lock()
+	defer lobbyMu.Unlock()
+	if _, ok := lobbySubscribers[c]; ok {
+		delete(lobbySubscribers, c)
+		close(c)
+	}
+}
+
+func acceptChallenge(id uuid.UUID) (*humanGame, core.Color, error) {
+	ch, ok := removeChallenge(id)
+	if !ok {
+		return nil, 0, fmt.Errorf("challenge not found (id %v)", id)
+	}
+
+	humanMu.Lock()
+	hg := humanGames[id]
+	humanMu.Unlock()
+
+	if hg == nil {
+		return nil, 0, errors.New("challenge no longer available")
+	}
+	return hg, ch.Color, nil
+}
+
+func (c *client) acceptChallenge(data lobbyAcceptData) {
+	hg, color, err := acceptChallenge(data.Id)
+	if err != nil {
+		c.err(err)
+		return
+	}
+	c.joinHumanGame(hg, color)
+}
+
+// Streams lobby changes until the connection closes or the client accepts a
+// challenge
+func (c *client) watchLobby() {
+	events, open := subscribeLobby()
+	c.trySend(lobbyMessageFrom(open))
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				// Dropped for falling behind, start over from a fresh listing
+				events, open = subscribeLobby()
+				c.trySend(lobbyMessageFrom(open))
+				continue
+			}
+			c.trySend(ev)
+		case bs, ok := <-c.incoming:
+			if !ok {
+				unsubscribeLobby(events)
+				return
+			}
+			var envelope messageEnvelope
+			if err := json.Unmarshal(bs, &envelope); err != nil {
+				c.err(err)
+				continue
+			}
+			if envelope.Type != "lobby/accept" {
+				c.errorf("can't send %q messages in the lobby", envelope.Type)
+				continue
+			}
+			var data lobbyAcceptData
+			if err := json.Unmarshal(envelope.Raw, &data); err != nil {
+				c.err(err)
+				continue
+			}
+			hg, color, err := acceptChallenge(data.Id)
+			if err != nil {
+				c.err(err)
+				continue
+			}
+			unsubscribeLobby(events)
+			c.joinHumanGame(hg, color)
+			return
+		}
+	}
+}
+
+func handleGetLobby(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	bytes, err := json.Marshal(openChallenges())
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, "json encode failed")
+		return
+	}
+
+	if _, err := w.Write(bytes); err != nil {
+		writeJsonError(w, http.StatusInternalServerError, "response body write failed")
+	}
+}
@@ -1,7 +1,8 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
@@ -19,92 +20,159 @@ type machGame struct {
 	id uuid.UUID
 	*conGame
 	humanColor core.Color
-	searcher   minimax.Searcher
+	machine    machinePlayer
 }
 
-func newMachGame(searcher minimax.Searcher, humanColor core.Color) (*machGame, error) {
+func newMachGame(searcher minimax.Searcher, heuristic minimax.Heuristic, humanColor core.Color, opts gameOptions) (*machGame, error) {
 	id, err := uuid.NewRandom()
 	if err != nil {
 		return nil, err
 	}
+	spectatorToken, err := spectatorTokenFor(opts)
+	if err != nil {
+		return nil, err
+	}
 	mg := &machGame{
 		id:         id,
-		conGame:    newConGame(),
-		searcher:   searcher,
+		conGame:    newConGame(opts),
 		humanColor: humanColor,
+		machine:    newMachinePlayer(humanColor.Opposite(), searcher, heuristic),
 	}
-	go mg.runMachine()
+	mg.spectatorToken = spectatorToken
+	mg.machineOpponent = true
+	mg.newRematch = mg.rematch
+	go mg.machine.run(mg.conGame)
 	return mg, nil
 }
 
-func (mg *machGame) runMachine() {
-	if !mg.machineHandleState(mg.current()) {
-		return
+// Creates the next game of the series, with the same settings but the colors
+// swapped. Must be called with gameMu held.
+func (mg *machGame) rematch() (*rematch, error) {
+	next, err := newMachGame(mg.machine.searcher, mg.machine.heuristic, mg.humanColor.Opposite(), mg.opts)
+	if err != nil {
+		return nil, err
 	}
+	next.series = mg.seriesOf(mg.id)
+	registerMachGame(next)
+	return &rematch{
+		id:     next.id,
+		series: next.series,
+		join: func(c *client, previous core.Color) {
+			c.joinMachGame(next)
+		},
+	}, nil
+}
 
-	states := mg.channel()
-	for s := range states {
-		if !mg.machineHandleState(s) {
-			mg.conGame.detach(states)
-		}
-	}
+func registerMachGame(mg *machGame) {
+	machMu.Lock()
+	machGames[mg.id] = mg
+	machMu.Unlock()
+
+	go monitorGame(machineMode, mg.conGame, mg.id, machGames, &machMu)
 }
 
-func (mg *machGame) machineHandleState(s gameState) bool {
-	machColor := mg.humanColor.Opposite()
-	if s.toPlay != machColor {
-		return true
-	}
-	if s.result.Over() {
-		return false
+func (d searcherData) searcher() (minimax.Searcher, minimax.Heuristic, error) {
+	searcher, heuristic, err := d.engine()
+	if err != nil {
+		return nil, nil, err
 	}
-	ply := mg.searcher.Search(mg.game.Copy())
-	if err := mg.doGivenPly(machColor, s.version, ply); err != nil {
-		log.Printf("failed to do machine ply: %v", err)
+	if book != nil && (d.Book == nil || *d.Book) {
+		searcher = bookSearcher{Searcher: searcher, book: book}
 	}
-	return true
+	return searcher, heuristic, nil
 }
 
-func (c *client) startMachineGame(data machNewData) {
-	heuristic := minimax.HeuristicFromString(data.Heuristic)
+// The searcher without the opening book
+func (d searcherData) engine() (minimax.Searcher, minimax.Heuristic, error) {
+	if d.Level != "" {
+		if d.Heuristic != "" || d.TimeLimitMs != 0 || d.DepthLimit != 0 || d.NodeLimit != 0 {
+			return nil, nil, errors.New("use either a level or a heuristic and search limits")
+		}
+		level, err := difficultyFromString(d.Level)
+		if err != nil {
+			return nil, nil, err
+		}
+		return level.searcher(), level.heuristic, nil
+	}
+
+	heuristic := minimax.HeuristicFromString(d.Heuristic)
 	if heuristic == nil {
-		c.errorf("unknown heuristic: %v", heuristic)
-		return
+		return nil, nil, fmt.Errorf("unknown heuristic: %v", d.Heuristic)
 	}
 
-	if data.TimeLimitMs <= 0 {
-		c.errorf("invalid time (ms) %d", data.TimeLimitMs)
-		return
+	if d.DepthLimit != 0 || d.NodeLimit != 0 {
+		if d.TimeLimitMs != 0 {
+			return nil, nil, errors.New("use either a time limit or depth and node limits")
+		}
+		if d.DepthLimit < 0 || d.DepthLimit > maxDepthLimit {
+			return nil, nil, fmt.Errorf("invalid depth limit %d, can't be negative or above %d", d.DepthLimit, maxDepthLimit)
+		}
+		if d.NodeLimit < 0 || d.NodeLimit > maxNodeLimit {
+			return nil, nil, fmt.Errorf("invalid node limit %d, can't be negative or above %d", d.NodeLimit, maxNodeLimit)
+		}
+		searcher := fixedSearcher{
+			Heuristic:  heuristic,
+			DepthLimit: d.DepthLimit,
+			NodeLimit:  d.NodeLimit,
+		}
+		return searcher, heuristic, nil
 	}
-	timeLimit := time.Duration(data.TimeLimitMs * int(time.Millisecond))
 
-	human := data.HumanColor
+	if d.TimeLimitMs <= 0 {
+		return nil, nil, fmt.Errorf("invalid time (ms) %d", d.TimeLimitMs)
+	}
+	timeLimit := time.Duration(d.TimeLimitMs * int(time.Millisecond))
+
 	searcher := minimax.TimeLimitedSearcher{
 		Heuristic: heuristic,
 		TimeLimit: timeLimit,
-		ToMax:     human.Opposite(),
 	}
+	return searcher, heuristic, nil
+}
+
+// Describes the settings, to name players who weren't given a name
+func (d searcherData) describe() string {
+	switch {
+	case d.Level != "":
+		return d.Level
+	case d.DepthLimit != 0 && d.NodeLimit != 0:
+		return fmt.Sprintf("%v/depth %d/%d nodes", d.Heuristic, d.DepthLimit, d.NodeLimit)
+	case d.DepthLimit != 0:
+		return fmt.Sprintf("%v/depth %d", d.Heuristic, d.DepthLimit)
+	case d.NodeLimit != 0:
+		return fmt.Sprintf("%v/%d nodes", d.Heuristic, d.NodeLimit)
+	default:
+		return fmt.Sprintf("%v/%dms", d.Heuristic, d.TimeLimitMs)
+	}
+}
 
-	mg, err := newMachGame(searcher, human)
+func (c *client) startMachineGame(data machNewData) {
+	searcher, heuristic, err := data.searcher()
 	if err != nil {
 		c.err(err)
 		return
 	}
 
-	machMu.Lock()
-	machGames[mg.id] = mg
-	machMu.Unlock()
-
-	go monitorGame(machineMode, mg.conGame, mg.id, 2*time.Minute, machGames, &machMu)
-
-	c.trySend(machConnectedMessageFrom(human, mg.id))
-	c.trySend(gameStateMessageFrom(mg.current(), human))
+	opts, err := data.options()
+	if err != nil {
+		c.err(err)
+		return
+	}
+	// Otherwise waiting for the machine would look like abandoning the game
+	if limit := timeLimitOf(searcher); opts.idleTimeout <= limit {
+		c.errorf("idle timeout %v must be longer than the machine's time limit %v", opts.idleTimeout, limit)
+		return
+	}
 
-	states := mg.channel()
-	go c.consumeGameStates(human, states)
+	human := data.HumanColor
+	mg, err := newMachGame(searcher, heuristic, human, opts)
+	if err != nil {
+		c.err(err)
+		return
+	}
 
-	c.runPlayer(human, mg.conGame)
-	mg.detach(states)
+	registerMachGame(mg)
+	c.joinMachGame(mg)
 }
 
 func (c *client) connectToMachineGame(data machConnectData) {
@@ -117,14 +185,31 @@ func (c *client) connectToMachineGame(data machConnectData) {
 		return
 	}
 
+	c.joinMachGame(mg)
+}
+
+func (c *client) joinMachGame(mg *machGame) {
 	human := mg.humanColor
 
-	c.trySend(machConnectedMessageFrom(human, mg.id))
-	c.trySend(gameStateMessageFrom(mg.current(), human))
+	c.trySend(machConnectedMessageFrom(human, mg.id, mg.spectatorToken))
+
+	c.play(human, mg.conGame)
+}
+
+func (c *client) watchMachineGame(data watchData) {
+	machMu.Lock()
+	mg := machGames[data.Id]
+	machMu.Unlock()
 
-	states := mg.channel()
-	go c.consumeGameStates(human, states)
+	if mg == nil {
+		c.errorf("machine game not found (id %v)", data.Id)
+		return
+	}
+	if err := mg.validateSpectatorToken(data.Token); err != nil {
+		c.err(err)
+		return
+	}
 
-	c.runPlayer(human, mg.conGame)
-	mg.detach(states)
+	c.trySend(watchingMessageFrom("mach/watching", mg.id))
+	c.spectate(mg.conGame)
 }
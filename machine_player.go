@@ -0,0 +1,231 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/luc527/go_checkers/core"
+	"github.com/luc527/go_checkers/minimax"
+)
+
+const (
+	// How deep the machine looks ahead when deciding whether to accept a draw
+	drawOfferDepth = 4
+	// Fraction of its remaining time the machine is willing to spend on one ply
+	machineClockFraction = 20
+)
+
+// Plays one side of a game, searching for its plies with minimax
+type machinePlayer struct {
+	color     core.Color
+	searcher  minimax.Searcher
+	heuristic minimax.Heuristic
+}
+
+func newMachinePlayer(color core.Color, searcher minimax.Searcher, heuristic minimax.Heuristic) machinePlayer {
+	return machinePlayer{
+		color:     color,
+		searcher:  searcherFor(searcher, color),
+		heuristic: heuristic,
+	}
+}
+
+// The same searcher, but playing as the given color
+func searcherFor(searcher minimax.Searcher, color core.Color) minimax.Searcher {
+	switch s := searcher.(type) {
+	case minimax.TimeLimitedSearcher:
+		s.ToMax = color
+		return s
+	case minimax.DepthLimitedSearcher:
+		s.ToMax = color
+		return s
+	case fixedSearcher:
+		s.ToMax = color
+		return s
+	case searcherWrapper:
+		return s.with(searcherFor(s.unwrap(), color))
+	default:
+		log.Printf("searcherFor: unknown searcher %T", searcher)
+		return searcher
+	}
+}
+
+// Plays until the game is over
+func (p machinePlayer) run(g *conGame) {
+	// Subscribe before handling the current state so no state is missed
+	events := g.playerChannel(p.color)
+	defer g.detach(events)
+	states := latestStates(events)
+
+	if !p.handleState(g, g.current()) {
+		return
+	}
+	for s := range states {
+		if !p.handleState(g, s) {
+			return
+		}
+	}
+}
+
+// Receives the events on a goroutine of its own, so the game never waits on
+// the machine while it searches, keeping only the latest state, the only one
+// the machine cares about. The returned channel is closed along with events.
+func latestStates(events chan gameEvent) chan gameState {
+	states := make(chan gameState, 1)
+	go func() {
+		defer close(states)
+		for ev := range events {
+			s, ok := ev.(gameState)
+			if !ok {
+				continue
+			}
+			// The only sender, so the buffer is free once emptied
+			select {
+			case <-states:
+			default:
+			}
+			states <- s
+		}
+	}()
+	return states
+}
+
+func (p machinePlayer) handleState(g *conGame, s gameState) bool {
+	if s.result.Over() {
+		return false
+	}
+	if offer := g.current().drawOffer; offer != nil && *offer != p.color {
+		p.answerDrawOffer(g)
+	}
+	p.answerTakeback(g)
+	if s.toPlay != p.color {
+		return true
+	}
+	// Stale state, either already handled or superseded by a newer one
+	if s.version != g.current().version {
+		return true
+	}
+	t, err := p.search(g, s)
+	if err != nil {
+		// The game ended while the machine was thinking
+		return false
+	}
+	if err := g.doGivenPly(p.color, s.version, t.ply); err != nil {
+		log.Printf("failed to do machine ply: %v", err)
+		return true
+	}
+	g.publish(machThoughtMessageFrom(p.color, t, true))
+	return true
+}
+
+// Plays from the opening book or the endgame table if it can, otherwise
+// waits for its turn to use the CPU, then searches for the ply
+func (p machinePlayer) search(g *conGame, s gameState) (thought, error) {
+	defer g.machineThinking()()
+
+	game, specialPlies := g.positionCopy()
+	ply, searcher := bookPly(p.searcher, game)
+	if ply != nil {
+		return thought{ply: ply, source: bookSource}, nil
+	}
+	if t, ok := endgames.think(game, specialPlies); ok {
+		return t, nil
+	}
+
+	release, err := scheduler.acquire(g.ctx, g, func(ahead int) {
+		g.publish(machStatusMessageFrom(p.color, "queued", ahead))
+	})
+	if err != nil {
+		return thought{}, err
+	}
+	// Searches return only once they've stopped, even when cancelled, so the
+	// slot isn't handed over while this one still uses the CPU
+	defer release()
+
+	g.publish(machStatusMessageFrom(p.color, "thinking", 0))
+	var progress func(thought)
+	if g.opts.thoughtProgress {
+		progress = func(t thought) {
+			g.publish(machThoughtMessageFrom(p.color, t, false))
+		}
+	}
+	// Budgeted only now, since the clock keeps running while queued
+	return think(g.ctx, p.budgetedSearcher(searcher, s), game, progress)
+}
+
+// With a clock, the machine doesn't think for longer than a fraction of its
+// remaining time, since the search is charged to its clock like any other
+func (p machinePlayer) budgetedSearcher(searcher minimax.Searcher, s gameState) minimax.Searcher {
+	if s.clock == nil {
+		return searcher
+	}
+	return budgeted(searcher, s.clock.remainingAt(p.color, time.Now())/machineClockFraction)
+}
+
+func budgeted(searcher minimax.Searcher, budget time.Duration) minimax.Searcher {
+	switch s := searcher.(type) {
+	case minimax.TimeLimitedSearcher:
+		if budget < s.TimeLimit {
+			s.TimeLimit = budget
+		}
+		return s
+	case searcherWrapper:
+		return s.with(budgeted(s.unwrap(), budget))
+	case minimax.DepthLimitedSearcher, fixedSearcher:
+		// Not limited by time
+		return searcher
+	default:
+		log.Printf("budgeted: unknown searcher %T", searcher)
+		return searcher
+	}
+}
+
+// How long the searcher thinks about one ply at most, zero if it isn't
+// limited by time
+func timeLimitOf(searcher minimax.Searcher) time.Duration {
+	switch s := searcher.(type) {
+	case minimax.TimeLimitedSearcher:
+		return min(max(s.TimeLimit, minimax.MinTimeLimit), minimax.MaxTimeLimit)
+	case searcherWrapper:
+		return timeLimitOf(s.unwrap())
+	default:
+		return 0
+	}
+}
+
+// The machine accepts a draw only when it thinks it's losing
+func (p machinePlayer) answerDrawOffer(g *conGame) {
+	release, err := scheduler.acquire(g.ctx, g, nil)
+	if err != nil {
+		return
+	}
+	value := evaluate(g.gameCopy(), p.heuristic, p.color, drawOfferDepth)
+	release()
+
+	if value < drawValue {
+		err = g.acceptDraw(p.color)
+	} else {
+		err = g.declineDraw(p.color)
+	}
+	if err != nil {
+		log.Printf("failed to answer draw offer: %v", err)
+	}
+}
+
+// The machine always accepts takebacks, also taking back its own reply so
+// the opponent is back on move
+func (p machinePlayer) answerTakeback(g *conGame) {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+
+	req := g.takeback
+	if req == nil || req.by == p.color {
+		return
+	}
+
+	// requestTakeback already checked that the history is long enough
+	if err := g.rollbackInner(g.machineTakebackPlies(req)); err != nil {
+		log.Printf("failed to take back: %v", err)
+		g.clearTakebackInner()
+	}
+}
@@ -6,13 +6,26 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"runtime"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
 
-var port = flag.String("port", "88", "http service port")
+var (
+	port                   = flag.String("port", "88", "http service port")
+	defaultIdleTimeout     = flag.Duration("idle-timeout", 2*time.Minute, "how long a game can go without activity before it's considered abandoned, unless set when creating the game")
+	defaultAbandonPolicy   = flag.String("abandon-policy", "forfeit", "result of an abandoned game, unless set when creating the game: forfeit (the player to move loses) or draw")
+	defaultDisconnectGrace = flag.Duration("disconnect-grace", 30*time.Second, "how long a player can stay disconnected before the opponent can claim the win, unless set when creating the game")
+	defaultRematchWindow   = flag.Duration("rematch-window", 30*time.Second, "how long the players have to agree on a rematch once the game is over (0 disables rematches), unless set when creating the game")
+	searchWorkers          = flag.Int("search-workers", runtime.NumCPU(), "how many machine searches can run at the same time, the others wait in line")
+	defaultNoProgressLimit = flag.Int("no-progress-limit", 20, "plies without a capture or pawn move before the game is drawn (0 for no limit), unless set when creating the game")
+	bookPath               = flag.String("book", "", "opening book for the machine players, built with the book command (none if empty)")
+	endgamesPath           = flag.String("endgames", "", "endgame table for the machine players and evaluations, built with the endgame command (none if empty)")
+)
 
 var upgrader = websocket.Upgrader{
 	// This is not secure, but I'm just trying to avoid cors problems when running on localhost
@@ -24,12 +37,47 @@ var upgrader = websocket.Upgrader{
 func main() {
 	uuid.SetRand(rand.Reader)
 
+	if len(os.Args) > 1 && os.Args[1] == "tournament" {
+		runTournamentCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "book" {
+		runBookCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "endgame" {
+		runEndgameCommand(os.Args[2:])
+		return
+	}
+
 	runServer()
 }
 
 func runServer() {
 	flag.Parse()
 
+	if _, err := defaultGameOptions(); err != nil {
+		log.Fatalln(err)
+	}
+
+	if *bookPath != "" {
+		b, err := loadBook(*bookPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		book = b
+		log.Printf("loaded book with %d positions from %v\n", len(b), *bookPath)
+	}
+
+	if *endgamesPath != "" {
+		t, err := loadEndgameTable(*endgamesPath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		endgames = t
+		log.Printf("loaded endgame table for up to %d pieces from %v\n", t.pieces, *endgamesPath)
+	}
+
 	r := mux.NewRouter()
 
 	r.HandleFunc("/ws", handleWebsocketRequest).Methods("GET")
@@ -41,6 +89,11 @@ func runServer() {
 	r.HandleFunc("/games", handleGetGames).Methods("GET")
 	r.HandleFunc("/game", handleGetGame).Methods("GET")
 
+	r.HandleFunc("/lobby", handleGetLobby).Methods("GET")
+
+	r.HandleFunc("/tournament", handlePostTournament).Methods("POST")
+	r.HandleFunc("/tournament", handleGetTournament).Methods("GET")
+
 	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "hello world!")
 	}).Methods("GET")
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/luc527/go_checkers/core"
@@ -19,24 +20,124 @@ type stringMessage struct {
 }
 
 type machConnectedMessage struct {
-	Type      string     `json:"type"`
-	Id        uuid.UUID  `json:"id"`
-	YourColor core.Color `json:"yourColor"`
+	Type           string     `json:"type"`
+	Id             uuid.UUID  `json:"id"`
+	YourColor      core.Color `json:"yourColor"`
+	SpectatorToken string     `json:"spectatorToken,omitempty"`
 }
 
 type humanCreatedMessage struct {
-	Type          string     `json:"type"`
-	Id            uuid.UUID  `json:"id"`
-	YourColor     core.Color `json:"yourColor"`
-	YourToken     string     `json:"yourToken"`
-	OpponentToken string     `json:"opponentToken"`
+	Type           string     `json:"type"`
+	Id             uuid.UUID  `json:"id"`
+	YourColor      core.Color `json:"yourColor"`
+	YourToken      string     `json:"yourToken"`
+	OpponentToken  string     `json:"opponentToken"`
+	SpectatorToken string     `json:"spectatorToken,omitempty"`
 }
 
 type humanConnectedMessage struct {
+	Type           string     `json:"type"`
+	Id             uuid.UUID  `json:"id"`
+	YourColor      core.Color `json:"yourColor"`
+	YourToken      string     `json:"yourToken"`
+	SpectatorToken string     `json:"spectatorToken,omitempty"`
+}
+
+type exhibitionCreatedMessage struct {
+	Type           string    `json:"type"`
+	Id             uuid.UUID `json:"id"`
+	SpectatorToken string    `json:"spectatorToken,omitempty"`
+}
+
+type watchingMessage struct {
+	Type string    `json:"type"`
+	Id   uuid.UUID `json:"id"`
+}
+
+type chatMessage struct {
+	Type string `json:"type"`
+	chatLine
+}
+
+type chatBacklogMessage struct {
+	Type     string     `json:"type"`
+	Messages []chatLine `json:"messages"`
+}
+
+type lobbyMessage struct {
+	Type       string      `json:"type"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type challengeAddedMessage struct {
+	Type      string    `json:"type"`
+	Challenge challenge `json:"challenge"`
+}
+
+type challengeRemovedMessage struct {
+	Type string    `json:"type"`
+	Id   uuid.UUID `json:"id"`
+}
+
+type rematchMessage struct {
+	Type string     `json:"type"`
+	By   core.Color `json:"by"`
+}
+
+type rematchStartedMessage struct {
+	Type string `json:"type"`
+	// Id of the new game
+	Id     uuid.UUID `json:"id"`
+	Series uuid.UUID `json:"series"`
+}
+
+type hintMessage struct {
+	Type    string  `json:"type"`
+	Version int     `json:"version"`
+	Index   int     `json:"index"`
+	Value   float64 `json:"value"`
+	// Hints used so far in the game, this one included
+	Used int `json:"used"`
+	// Value of the position after the ply in the endgame table, when it
+	// covers it
+	Endgame *endgameInfo `json:"endgame,omitempty"`
+}
+
+// What the machine playing the given color is doing
+type machStatusMessage struct {
+	Type   string     `json:"type"`
+	Color  core.Color `json:"color"`
+	Status string     `json:"status"`
+	// Searches that will run before the machine's, when it's queued
+	Ahead int `json:"ahead"`
+}
+
+// What the machine playing the given color thought of the position, sent
+// once it has chosen its ply and, if the game asks for it, while it's still
+// searching
+type machThoughtMessage struct {
+	Type  string     `json:"type"`
+	Color core.Color `json:"color"`
+	// False for the progress updates
+	Done bool `json:"done"`
+	// Best ply so far while searching, null until the first search iteration
+	// finishes
+	Ply core.Ply `json:"ply"`
+	// "search", "book", "endgame" or "blunder"
+	Source string `json:"source"`
+	// From the machine's point of view, absent when the ply wasn't searched for
+	Score *float64   `json:"score,omitempty"`
+	Depth int        `json:"depth"`
+	Nodes int        `json:"nodes"`
+	PV    []core.Ply `json:"pv"`
+}
+
+type presenceMessage struct {
 	Type      string     `json:"type"`
-	Id        uuid.UUID  `json:"id"`
-	YourColor core.Color `json:"yourColor"`
-	YourToken string     `json:"yourToken"`
+	Color     core.Color `json:"color"`
+	Connected bool       `json:"connected"`
+	// Time left before the opponent can claim the win, when disconnected
+	GraceMs int64 `json:"graceMs,omitempty"`
 }
 
 func errorMessage(err string) stringMessage {
@@ -46,37 +147,231 @@ func errorMessage(err string) stringMessage {
 	}
 }
 
-func machConnectedMessageFrom(color core.Color, id uuid.UUID) machConnectedMessage {
+func presenceMessageFrom(color core.Color, connected bool, grace time.Duration) presenceMessage {
+	return presenceMessage{
+		Type:      "presence",
+		Color:     color,
+		Connected: connected,
+		GraceMs:   grace.Milliseconds(),
+	}
+}
+
+func chatMessageFrom(line chatLine) chatMessage {
+	return chatMessage{
+		Type:     "chat",
+		chatLine: line,
+	}
+}
+
+func chatBacklogMessageFrom(lines []chatLine) chatBacklogMessage {
+	return chatBacklogMessage{
+		Type:     "chat/backlog",
+		Messages: lines,
+	}
+}
+
+func lobbyMessageFrom(challenges []challenge) lobbyMessage {
+	return lobbyMessage{
+		Type:       "lobby",
+		Challenges: challenges,
+	}
+}
+
+func challengeAddedMessageFrom(ch challenge) challengeAddedMessage {
+	return challengeAddedMessage{
+		Type:      "lobby/added",
+		Challenge: ch,
+	}
+}
+
+func challengeRemovedMessageFrom(id uuid.UUID) challengeRemovedMessage {
+	return challengeRemovedMessage{
+		Type: "lobby/removed",
+		Id:   id,
+	}
+}
+
+func rematchMessageFrom(typ string, by core.Color) rematchMessage {
+	return rematchMessage{
+		Type: typ,
+		By:   by,
+	}
+}
+
+func rematchStartedMessageFrom(r *rematch) rematchStartedMessage {
+	return rematchStartedMessage{
+		Type:   "rematch/started",
+		Id:     r.id,
+		Series: r.series,
+	}
+}
+
+func machStatusMessageFrom(color core.Color, status string, ahead int) machStatusMessage {
+	return machStatusMessage{
+		Type:   "mach/status",
+		Color:  color,
+		Status: status,
+		Ahead:  ahead,
+	}
+}
+
+func machThoughtMessageFrom(color core.Color, t thought, done bool) machThoughtMessage {
+	pv := t.pv
+	if pv == nil {
+		pv = []core.Ply{}
+	}
+	return machThoughtMessage{
+		Type:   "mach/thought",
+		Color:  color,
+		Done:   done,
+		Ply:    t.ply,
+		Source: t.source,
+		Score:  t.score,
+		Depth:  t.depth,
+		Nodes:  t.nodes,
+		PV:     pv,
+	}
+}
+
+func hintMessageFrom(h hint) hintMessage {
+	return hintMessage{
+		Type:    "hint",
+		Version: h.version,
+		Index:   h.index,
+		Value:   h.value,
+		Used:    h.used,
+		Endgame: endgameInfoFrom(h.endgame),
+	}
+}
+
+func machConnectedMessageFrom(color core.Color, id uuid.UUID, spectatorToken string) machConnectedMessage {
 	return machConnectedMessage{
-		Type:      "mach/connected",
-		Id:        id,
-		YourColor: color,
+		Type:           "mach/connected",
+		Id:             id,
+		YourColor:      color,
+		SpectatorToken: spectatorToken,
 	}
 }
 
-func humanCreatedMessageFrom(color core.Color, id uuid.UUID, yourToken string, OpponentToken string) humanCreatedMessage {
+func humanCreatedMessageFrom(color core.Color, id uuid.UUID, yourToken string, OpponentToken string, spectatorToken string) humanCreatedMessage {
 	return humanCreatedMessage{
-		Type:          "human/created",
-		Id:            id,
-		YourColor:     color,
-		YourToken:     yourToken,
-		OpponentToken: OpponentToken,
+		Type:           "human/created",
+		Id:             id,
+		YourColor:      color,
+		YourToken:      yourToken,
+		OpponentToken:  OpponentToken,
+		SpectatorToken: spectatorToken,
 	}
 }
 
-func humanConnectedMessageFrom(color core.Color, id uuid.UUID, token string) humanConnectedMessage {
+func humanConnectedMessageFrom(color core.Color, id uuid.UUID, token string, spectatorToken string) humanConnectedMessage {
 	return humanConnectedMessage{
-		Type:      "human/connected",
-		Id:        id,
-		YourColor: color,
-		YourToken: token,
+		Type:           "human/connected",
+		Id:             id,
+		YourColor:      color,
+		YourToken:      token,
+		SpectatorToken: spectatorToken,
+	}
+}
+
+func seekingMessageFrom() stringMessage {
+	return stringMessage{
+		Type:    "human/seeking",
+		Message: "waiting for an opponent",
 	}
 }
 
+func exhibitionCreatedMessageFrom(id uuid.UUID, spectatorToken string) exhibitionCreatedMessage {
+	return exhibitionCreatedMessage{
+		Type:           "exhibition/created",
+		Id:             id,
+		SpectatorToken: spectatorToken,
+	}
+}
+
+func watchingMessageFrom(typ string, id uuid.UUID) watchingMessage {
+	return watchingMessage{
+		Type: typ,
+		Id:   id,
+	}
+}
+
+// Settings shared by the messages that create games
+type gameOptionsData struct {
+	TimeControl       *timeControlData `json:"timeControl"`
+	IdleTimeoutMs     int              `json:"idleTimeoutMs"`
+	AbandonPolicy     string           `json:"abandonPolicy"`
+	DisconnectGraceMs int              `json:"disconnectGraceMs"`
+	// How long the players have to agree on a rematch, 0 disables rematches;
+	// by default the server's
+	RematchWindowMs *int `json:"rematchWindowMs"`
+	// Whether spectators need a token to watch the game
+	PrivateWatch bool `json:"privateWatch"`
+	// Whether spectators can send chat messages
+	SpectatorChat bool `json:"spectatorChat"`
+	// Plies without a capture or pawn move before the game is drawn, 0 for no
+	// limit; by default the server's
+	NoProgressLimit *int `json:"noProgressLimit"`
+	// Whether the players can ask the engine for hints
+	Hints bool `json:"hints"`
+	// Attaches an evaluation to the state messages when present
+	Evaluation *evaluationData `json:"evaluation"`
+	// Whether machine players report what they're thinking while they search,
+	// not only once they've played
+	ThoughtProgress bool `json:"thoughtProgress"`
+	// Position to start from instead of the standard one, serialized like
+	// the board in state messages, with white to play unless told otherwise
+	Board  string      `json:"board"`
+	ToPlay *core.Color `json:"toPlay"`
+}
+
+type evaluationData struct {
+	// Weighted count by default
+	Heuristic string `json:"heuristic"`
+	Depth     int    `json:"depth"`
+}
+
+type timeControlData struct {
+	BaseMs      int `json:"baseMs"`
+	IncrementMs int `json:"incrementMs"`
+	DelayMs     int `json:"delayMs"`
+}
+
+func timeControlDataFrom(tc timeControl) *timeControlData {
+	if !tc.enabled() {
+		return nil
+	}
+	return &timeControlData{
+		BaseMs:      int(tc.base.Milliseconds()),
+		IncrementMs: int(tc.increment.Milliseconds()),
+		DelayMs:     int(tc.delay.Milliseconds()),
+	}
+}
+
+// Engine settings for a machine player, either a named difficulty level or
+// the heuristic and how long to search: a time limit, or a depth limit and/or
+// a node limit
+type searcherData struct {
+	Level       string `json:"level"`
+	Heuristic   string `json:"heuristic"`
+	TimeLimitMs int    `json:"timeLimitMs"`
+	DepthLimit  int    `json:"depthLimit"`
+	NodeLimit   int    `json:"nodeLimit"`
+	// Whether to play from the opening book, when the server has one; by
+	// default it does
+	Book *bool `json:"book"`
+}
+
 type machNewData struct {
-	HumanColor  core.Color `json:"humanColor"`
-	Heuristic   string     `json:"heuristic"`
-	TimeLimitMs int        `json:"timeLimitMs"`
+	HumanColor core.Color `json:"humanColor"`
+	searcherData
+	gameOptionsData
+}
+
+type exhibitionNewData struct {
+	White searcherData `json:"white"`
+	Black searcherData `json:"black"`
+	gameOptionsData
 }
 
 type gameStateMessage struct {
@@ -84,26 +379,115 @@ type gameStateMessage struct {
 	Board     core.Board      `json:"board"`
 	Version   int             `json:"version"`
 	Result    core.GameResult `json:"result"`
+	Reason    string          `json:"reason,omitempty"`
 	ToPlay    core.Color      `json:"toPlay"`
 	Plies     []core.Ply      `json:"plies"`
-	YourColor core.Color      `json:"yourColor"`
+	YourColor *core.Color     `json:"yourColor,omitempty"`
+	// Square notation of each ply, in the same order
+	Notation []string `json:"notation"`
+	// Whether the message is being sent to a spectator instead of a player
+	Spectating bool          `json:"spectating,omitempty"`
+	Spectators int           `json:"spectators"`
+	DrawOffer  *core.Color   `json:"drawOffer,omitempty"`
+	Takeback   *takebackInfo `json:"takeback,omitempty"`
+	Clock      *clockInfo    `json:"clock,omitempty"`
+	// From white's point of view, absent until it's computed
+	Evaluation *float64     `json:"evaluation,omitempty"`
+	Endgame    *endgameInfo `json:"endgame,omitempty"`
+}
+
+// Value of the position in the endgame table, which ignores the repetition
+// and no-progress rules
+type endgameInfo struct {
+	// Absent for a draw
+	Winner *core.Color `json:"winner,omitempty"`
+	// Until the winner wins
+	Plies int `json:"plies,omitempty"`
+}
+
+func endgameInfoFrom(v *endgameValue) *endgameInfo {
+	if v == nil {
+		return nil
+	}
+	return &endgameInfo{Winner: v.winner, Plies: v.plies}
+}
+
+type clockInfo struct {
+	WhiteMs int64 `json:"whiteMs"`
+	BlackMs int64 `json:"blackMs"`
+	// Color whose clock is running, absent when the clock is stopped
+	Running *core.Color `json:"running,omitempty"`
+}
+
+func clockInfoFrom(c clockState, now time.Time) *clockInfo {
+	info := &clockInfo{
+		WhiteMs: c.remainingAt(whiteColor, now).Milliseconds(),
+		BlackMs: c.remainingAt(blackColor, now).Milliseconds(),
+	}
+	if c.running {
+		running := c.toPlay
+		info.Running = &running
+	}
+	return info
+}
+
+type takebackInfo struct {
+	By    core.Color `json:"by"`
+	Plies int        `json:"plies"`
 }
 
 func gameStateMessageFrom(s gameState, player core.Color) gameStateMessage {
+	var takeback *takebackInfo
+	if s.takeback != nil {
+		takeback = &takebackInfo{
+			By:    s.takeback.by,
+			Plies: s.takeback.plies,
+		}
+	}
+	var clock *clockInfo
+	if s.clock != nil {
+		clock = clockInfoFrom(*s.clock, time.Now())
+	}
 	return gameStateMessage{
-		Type:      "state",
-		Board:     s.board,
-		Version:   s.version,
-		Result:    s.result,
-		ToPlay:    s.toPlay,
-		Plies:     s.plies,
-		YourColor: player,
+		Type:       "state",
+		Board:      s.board,
+		Version:    s.version,
+		Result:     s.result,
+		Reason:     s.reason,
+		ToPlay:     s.toPlay,
+		Plies:      s.plies,
+		Notation:   pliesNotation(s.plies),
+		YourColor:  &player,
+		Spectators: s.spectators,
+		DrawOffer:  s.drawOffer,
+		Takeback:   takeback,
+		Clock:      clock,
+		Evaluation: s.evaluation,
+		Endgame:    endgameInfoFrom(s.endgame),
 	}
 }
 
+func spectatorStateMessageFrom(s gameState) gameStateMessage {
+	msg := gameStateMessageFrom(s, whiteColor)
+	msg.YourColor = nil
+	msg.Spectating = true
+	return msg
+}
+
 type plyData struct {
 	Version int `json:"version"`
 	Index   int `json:"ply"`
+	// Names the ply in square notation (e.g. 11-15 or 22x15x8) instead of by
+	// index when given
+	Notation string `json:"notation"`
+}
+
+type takebackData struct {
+	Plies int `json:"plies"`
+}
+
+type chatData struct {
+	Text string `json:"text"`
 }
 
 type machConnectData struct {
@@ -112,6 +496,25 @@ type machConnectData struct {
 
 type humanNewData struct {
 	Color core.Color `json:"color"`
+	// Whether to list the game in the lobby, so anyone can join as the opponent
+	Open bool `json:"open"`
+	gameOptionsData
+}
+
+type lobbyAcceptData struct {
+	Id uuid.UUID `json:"id"`
+}
+
+type watchData struct {
+	Id uuid.UUID `json:"id"`
+	// Only needed when the game was created with privateWatch
+	Token string `json:"token"`
+}
+
+type seekData struct {
+	// Only paired with seekers that want the same time control, no time
+	// control if nil
+	TimeControl *timeControlData `json:"timeControl"`
 }
 
 type humanConnectData struct {
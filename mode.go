@@ -7,6 +7,8 @@ type gameMode byte
 const (
 	humanMode = gameMode(iota)
 	machineMode
+	exhibitionMode
+	tournamentMode
 )
 
 func (m gameMode) String() string {
@@ -15,6 +17,10 @@ func (m gameMode) String() string {
 		return "human"
 	case machineMode:
 		return "machine"
+	case exhibitionMode:
+		return "exhibition"
+	case tournamentMode:
+		return "tournament"
 	default:
 		return "invalid"
 	}
@@ -26,6 +32,10 @@ func ModeFromString(s string) (gameMode, error) {
 		return humanMode, nil
 	case "machine":
 		return machineMode, nil
+	case "exhibition":
+		return exhibitionMode, nil
+	case "tournament":
+		return tournamentMode, nil
 	default:
 		return 0, fmt.Errorf("invalid game mode %v", s)
 	}
@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestGameMode(t *testing.T) {
 	if humanMode.String() != "human" {
@@ -9,6 +12,9 @@ func TestGameMode(t *testing.T) {
 	if machineMode.String() != "machine" {
 		t.FailNow()
 	}
+	if mode, err := ModeFromString(exhibitionMode.String()); err != nil || mode != exhibitionMode {
+		t.FailNow()
+	}
 	if gameMode(123).String() != "invalid" {
 		t.FailNow()
 	}
@@ -22,3 +28,55 @@ func TestGameMode(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestAbandonPolicy(t *testing.T) {
+	for _, p := range []abandonPolicy{forfeitOnAbandon, drawOnAbandon} {
+		if got, err := abandonPolicyFromString(p.String()); err != nil || got != p {
+			t.Fatalf("failed to round trip %v", p)
+		}
+	}
+	if _, err := abandonPolicyFromString("whatever"); err == nil {
+		t.FailNow()
+	}
+	if abandonPolicy(123).String() != "invalid" {
+		t.FailNow()
+	}
+
+	opts, err := gameOptionsData{IdleTimeoutMs: 5000, AbandonPolicy: "draw"}.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.idleTimeout != 5*time.Second || opts.abandonPolicy != drawOnAbandon {
+		t.Fatalf("wrong options %+v", opts)
+	}
+
+	opts, err = gameOptionsData{}.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.idleTimeout != *defaultIdleTimeout || opts.abandonPolicy != forfeitOnAbandon {
+		t.Fatalf("wrong default options %+v", opts)
+	}
+	if opts.noProgressLimit != *defaultNoProgressLimit {
+		t.Fatalf("expected the default no-progress limit, got %d", opts.noProgressLimit)
+	}
+	if opts.rematchWindow != *defaultRematchWindow || opts.rematchWindow <= 0 {
+		t.Fatalf("expected the default rematch window, got %v", opts.rematchWindow)
+	}
+
+	noLimit := 0
+	opts, err = gameOptionsData{NoProgressLimit: &noLimit, RematchWindowMs: &noLimit}.options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.noProgressLimit != 0 {
+		t.Fatalf("game should be able to turn the no-progress rule off, got %d", opts.noProgressLimit)
+	}
+	if opts.rematchWindow != 0 {
+		t.Fatalf("game should be able to turn rematches off, got %v", opts.rematchWindow)
+	}
+
+	if _, err := (gameOptionsData{IdleTimeoutMs: -1}).options(); err == nil {
+		t.FailNow()
+	}
+}
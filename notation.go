@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/luc527/go_checkers/core"
+)
+
+// Standard checkers notation: the dark squares are numbered 1 to 32 from the
+// top of the board, where black starts, and a ply is written as the squares
+// the piece goes through, separated by "-" for a simple move (11-15) and by
+// "x" for captures (22x15x8)
+
+// Number of the dark square in the given row and column
+func squareNumber(row, col byte) int {
+	return int(row)*4 + int(col)/2 + 1
+}
+
+// Serialized as its type ('m' for a move, 'c' for a capture, 'k' for a
+// crowning) followed by the row and column digits, and for a move the
+// destination's; core doesn't expose them otherwise
+func serializedInstruction(ins core.Instruction) []byte {
+	var buf bytes.Buffer
+	// Writing to a bytes.Buffer doesn't fail
+	ins.SerializeInto(&buf)
+	return buf.Bytes()
+}
+
+// Squares the piece moving in the ply stops at, starting where it was
+func plySquares(ply core.Ply) []int {
+	var squares []int
+	for _, ins := range ply {
+		bs := serializedInstruction(ins)
+		if bs[0] != 'm' {
+			continue
+		}
+		if squares == nil {
+			squares = append(squares, squareNumber(bs[1]-'0', bs[2]-'0'))
+		}
+		squares = append(squares, squareNumber(bs[3]-'0', bs[4]-'0'))
+	}
+	return squares
+}
+
+func isCapture(ply core.Ply) bool {
+	for _, ins := range ply {
+		if serializedInstruction(ins)[0] == 'c' {
+			return true
+		}
+	}
+	return false
+}
+
+func plyNotation(ply core.Ply) string {
+	sep := "-"
+	if isCapture(ply) {
+		sep = "x"
+	}
+	squares := plySquares(ply)
+	parts := make([]string, len(squares))
+	for i, square := range squares {
+		parts[i] = strconv.Itoa(square)
+	}
+	return strings.Join(parts, sep)
+}
+
+func pliesNotation(plies []core.Ply) []string {
+	notation := make([]string, len(plies))
+	for i, ply := range plies {
+		notation[i] = plyNotation(ply)
+	}
+	return notation
+}
+
+// Finds the ply the notation names among the given ones. A capture can also
+// be named only by where it starts and ends (22x8), as long as no other
+// capture does the same.
+func plyFromNotation(plies []core.Ply, notation string) (core.Ply, error) {
+	notation = strings.TrimSpace(notation)
+	capture := strings.Contains(notation, "x")
+	sep := "-"
+	if capture {
+		sep = "x"
+	}
+	parts := strings.Split(notation, sep)
+	if len(parts) < 2 || (!capture && len(parts) != 2) {
+		return nil, fmt.Errorf("ply notation: %q is not like 11-15 or 22x15x8", notation)
+	}
+	squares := make([]int, len(parts))
+	for i, part := range parts {
+		square, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("ply notation: %q is not like 11-15 or 22x15x8", notation)
+		}
+		if square < 1 || square > 32 {
+			return nil, fmt.Errorf("ply notation: square %d is not between 1 and 32", square)
+		}
+		squares[i] = square
+	}
+
+	var matches []core.Ply
+	for _, ply := range plies {
+		if isCapture(ply) != capture {
+			continue
+		}
+		plySquares := plySquares(ply)
+		full := slices.Equal(plySquares, squares)
+		endpoints := capture && len(squares) == 2 &&
+			plySquares[0] == squares[0] && plySquares[len(plySquares)-1] == squares[1]
+		if full || endpoints {
+			matches = append(matches, ply)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		if !capture && len(plies) > 0 && isCapture(plies[0]) {
+			return nil, fmt.Errorf("ply notation: %v is not legal, a capture is mandatory", notation)
+		}
+		return nil, fmt.Errorf("ply notation: %v is not legal", notation)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("ply notation: %v is ambiguous, could be %v", notation, strings.Join(pliesNotation(matches), " or "))
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/luc527/go_checkers/core"
+)
+
+type abandonPolicy byte
+
+const (
+	// The player who was supposed to move loses
+	forfeitOnAbandon = abandonPolicy(iota)
+	// The game ends in a draw
+	drawOnAbandon
+)
+
+func (p abandonPolicy) String() string {
+	switch p {
+	case forfeitOnAbandon:
+		return "forfeit"
+	case drawOnAbandon:
+		return "draw"
+	default:
+		return "invalid"
+	}
+}
+
+func abandonPolicyFromString(s string) (abandonPolicy, error) {
+	switch s {
+	case "forfeit":
+		return forfeitOnAbandon, nil
+	case "draw":
+		return drawOnAbandon, nil
+	default:
+		return 0, fmt.Errorf("invalid abandon policy %v", s)
+	}
+}
+
+// Settings chosen when creating a game
+type gameOptions struct {
+	timeControl timeControl
+	// How long the game can go without activity before it's considered abandoned
+	idleTimeout   time.Duration
+	abandonPolicy abandonPolicy
+	// How long a player can stay disconnected before the opponent can claim the win
+	disconnectGrace time.Duration
+	// Whether spectators need a token to watch the game
+	privateWatch bool
+	// Whether spectators can chat, players always can
+	spectatorChat bool
+	// How long the players have to agree on a rematch once the game is over,
+	// no rematches if zero
+	rematchWindow time.Duration
+	// nil for the standard starting position
+	start *startPosition
+	// Plies without a capture or pawn move before the game is drawn, zero for
+	// no limit
+	noProgressLimit int
+	// Whether the players can ask the engine for hints
+	hints bool
+	// nil when the state messages don't include an evaluation
+	evaluation *liveEvaluation
+	// Whether machine players report their search's progress
+	thoughtProgress bool
+}
+
+// Options used for settings not given when creating the game
+func defaultGameOptions() (gameOptions, error) {
+	policy, err := abandonPolicyFromString(*defaultAbandonPolicy)
+	if err != nil {
+		return gameOptions{}, err
+	}
+	if *defaultIdleTimeout <= 0 {
+		return gameOptions{}, errors.New("idle timeout must be positive")
+	}
+	if *defaultDisconnectGrace < 0 {
+		return gameOptions{}, errors.New("disconnect grace period can't be negative")
+	}
+	if *defaultRematchWindow < 0 {
+		return gameOptions{}, errors.New("rematch window can't be negative")
+	}
+	if *defaultNoProgressLimit < 0 {
+		return gameOptions{}, errors.New("no-progress limit can't be negative")
+	}
+	return gameOptions{
+		idleTimeout:     *defaultIdleTimeout,
+		abandonPolicy:   policy,
+		disconnectGrace: *defaultDisconnectGrace,
+		rematchWindow:   *defaultRematchWindow,
+		noProgressLimit: *defaultNoProgressLimit,
+	}, nil
+}
+
+func (d timeControlData) timeControl() (timeControl, error) {
+	if d.BaseMs <= 0 {
+		return timeControl{}, errors.New("time control: base time must be positive")
+	}
+	if d.IncrementMs < 0 || d.DelayMs < 0 {
+		return timeControl{}, errors.New("time control: increment and delay can't be negative")
+	}
+	if d.IncrementMs > 0 && d.DelayMs > 0 {
+		return timeControl{}, errors.New("time control: use either an increment or a delay, not both")
+	}
+	return timeControl{
+		base:      time.Duration(d.BaseMs) * time.Millisecond,
+		increment: time.Duration(d.IncrementMs) * time.Millisecond,
+		delay:     time.Duration(d.DelayMs) * time.Millisecond,
+	}, nil
+}
+
+func spectatorTokenFor(opts gameOptions) (string, error) {
+	if !opts.privateWatch {
+		return "", nil
+	}
+	return genToken()
+}
+
+func (d gameOptionsData) options() (gameOptions, error) {
+	opts, err := defaultGameOptions()
+	if err != nil {
+		return opts, err
+	}
+	if d.IdleTimeoutMs < 0 {
+		return opts, errors.New("idle timeout can't be negative")
+	}
+	if d.IdleTimeoutMs > 0 {
+		opts.idleTimeout = time.Duration(d.IdleTimeoutMs) * time.Millisecond
+	}
+	if d.DisconnectGraceMs < 0 {
+		return opts, errors.New("disconnect grace period can't be negative")
+	}
+	if d.DisconnectGraceMs > 0 {
+		opts.disconnectGrace = time.Duration(d.DisconnectGraceMs) * time.Millisecond
+	}
+	if d.RematchWindowMs != nil {
+		if *d.RematchWindowMs < 0 {
+			return opts, errors.New("rematch window can't be negative")
+		}
+		opts.rematchWindow = time.Duration(*d.RematchWindowMs) * time.Millisecond
+	}
+	if d.NoProgressLimit != nil {
+		if *d.NoProgressLimit < 0 {
+			return opts, errors.New("no-progress limit can't be negative")
+		}
+		opts.noProgressLimit = *d.NoProgressLimit
+	}
+	if d.AbandonPolicy != "" {
+		policy, err := abandonPolicyFromString(d.AbandonPolicy)
+		if err != nil {
+			return opts, err
+		}
+		opts.abandonPolicy = policy
+	}
+	opts.privateWatch = d.PrivateWatch
+	opts.spectatorChat = d.SpectatorChat
+	opts.hints = d.Hints
+	opts.thoughtProgress = d.ThoughtProgress
+	if d.Board == "" && d.ToPlay != nil {
+		return opts, errors.New("start position: toPlay needs a board to go with it")
+	}
+	if d.Board != "" {
+		toPlay := core.WhiteColor
+		if d.ToPlay != nil {
+			toPlay = *d.ToPlay
+		}
+		start, err := startPositionFrom(d.Board, toPlay)
+		if err != nil {
+			return opts, err
+		}
+		opts.start = start
+	}
+	if d.Evaluation != nil {
+		evaluation, err := d.Evaluation.liveEvaluation()
+		if err != nil {
+			return opts, err
+		}
+		opts.evaluation = evaluation
+	}
+	if d.TimeControl != nil {
+		tc, err := d.TimeControl.timeControl()
+		if err != nil {
+			return opts, err
+		}
+		opts.timeControl = tc
+	}
+	return opts, nil
+}
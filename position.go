@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/luc527/go_checkers/core"
+)
+
+const maxPiecesPerColor = 12
+
+// The core game's stagnation rule for the no-progress limit, so that searches
+// on copies of the game know about the draw too. Zero means no limit.
+func stagnantTurnsToDraw(noProgressLimit int) int16 {
+	if noProgressLimit <= 0 || noProgressLimit > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	return int16(noProgressLimit)
+}
+
+// Position a game starts from, when it's not the standard one
+type startPosition struct {
+	board  core.Board
+	toPlay core.Color
+}
+
+// Stored along with the plies, since they can't be replayed without it
+type startRecord struct {
+	Board  core.Board `json:"board"`
+	ToPlay core.Color `json:"toPlay"`
+}
+
+// Creates the game from the start position, or from the standard one if nil
+func (p *startPosition) newGame(noProgressLimit int) *core.Game {
+	stagnant := stagnantTurnsToDraw(noProgressLimit)
+	if p == nil {
+		return core.NewCustomGame(stagnant, nil, core.WhiteColor)
+	}
+	board := p.board
+	return core.NewCustomGame(stagnant, &board, p.toPlay)
+}
+
+func (p *startPosition) record() *startRecord {
+	if p == nil {
+		return nil
+	}
+	return &startRecord{Board: p.board, ToPlay: p.toPlay}
+}
+
+// Board the game starts from, for games stored with or without a start position
+func (r *startRecord) initialBoard() *core.Board {
+	board := new(core.Board)
+	if r == nil {
+		core.PlaceInitialPieces(board)
+	} else {
+		*board = r.Board
+	}
+	return board
+}
+
+func startPositionFrom(serialized string, toPlay core.Color) (*startPosition, error) {
+	var board core.Board
+	if err := board.Unserialize([]byte(serialized)); err != nil {
+		return nil, fmt.Errorf("start position: %v", err)
+	}
+
+	count := board.PieceCount()
+	whites := int(count.WhitePawns + count.WhiteKings)
+	blacks := int(count.BlackPawns + count.BlackKings)
+	if whites+blacks != len(serialized)/4 {
+		return nil, errors.New("start position: more than one piece on the same square")
+	}
+	if whites > maxPiecesPerColor || blacks > maxPiecesPerColor {
+		return nil, fmt.Errorf("start position: at most %d pieces per color", maxPiecesPerColor)
+	}
+
+	for row := byte(0); row < 8; row++ {
+		for col := byte(0); col < 8; col++ {
+			if !board.IsOccupied(row, col) {
+				continue
+			}
+			if core.TileColor(row, col) != core.BlackColor {
+				return nil, fmt.Errorf("start position: piece on a light square (row %d, col %d)", row, col)
+			}
+			color, kind := board.Get(row, col)
+			if kind == core.PawnKind && row == crowningRow(color) {
+				return nil, fmt.Errorf("start position: uncrowned pawn on its crowning row (row %d, col %d)", row, col)
+			}
+		}
+	}
+
+	p := &startPosition{board: board, toPlay: toPlay}
+	if p.newGame(0).Result().Over() {
+		return nil, errors.New("start position: game would already be over")
+	}
+	return p, nil
+}
+
+// Row where pawns of the given color are crowned
+func crowningRow(color core.Color) byte {
+	if color == core.WhiteColor {
+		return 0
+	}
+	return 7
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/luc527/go_checkers/core"
+)
+
+type playerPresence struct {
+	connections int
+	// Whether the player ever connected to the game
+	joined bool
+	leftAt time.Time
+}
+
+// Must be called with chansMu held
+func (g *conGame) playerJoined(color core.Color) {
+	g.presenceMu.Lock()
+	p := &g.presence[color]
+	p.connections++
+	p.joined = true
+	arrived := p.connections == 1
+	g.presenceMu.Unlock()
+
+	if arrived {
+		g.publish(g.presenceMessage(color))
+	}
+}
+
+// Must be called with chansMu held
+func (g *conGame) playerLeft(color core.Color) {
+	g.presenceMu.Lock()
+	p := &g.presence[color]
+	p.connections--
+	gone := p.connections == 0
+	if gone {
+		p.leftAt = time.Now()
+	}
+	g.presenceMu.Unlock()
+
+	if gone {
+		g.publish(g.presenceMessage(color))
+	}
+}
+
+func (g *conGame) playerPresence(color core.Color) playerPresence {
+	g.presenceMu.Lock()
+	defer g.presenceMu.Unlock()
+	return g.presence[color]
+}
+
+// How long until the opponent of a disconnected player can claim the win
+func (g *conGame) graceLeft(p playerPresence) time.Duration {
+	left := g.opts.disconnectGrace - time.Since(p.leftAt)
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+func (g *conGame) presenceMessage(color core.Color) presenceMessage {
+	p := g.playerPresence(color)
+	var grace time.Duration
+	if p.joined && p.connections == 0 {
+		grace = g.graceLeft(p)
+	}
+	return presenceMessageFrom(color, p.connections > 0, grace)
+}
+
+// The player claims the win because the opponent has been disconnected for
+// longer than the grace period
+func (g *conGame) claimWin(player core.Color) error {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+
+	if g.state.result.Over() {
+		return errors.New("claim win: game already over")
+	}
+
+	opponent := player.Opposite()
+	p := g.playerPresence(opponent)
+	if !p.joined {
+		return errors.New("claim win: opponent never connected")
+	}
+	if p.connections > 0 {
+		return errors.New("claim win: opponent is connected")
+	}
+	if left := g.graceLeft(p); left > 0 {
+		return fmt.Errorf("claim win: opponent can still reconnect for %v", left.Round(time.Second))
+	}
+
+	g.abandonedBy = &opponent
+	g.endInner(winResult(player), "disconnection")
+	return nil
+}
+
+// Must be called with chansMu held
+func (g *conGame) spectatorJoined() {
+	g.presenceMu.Lock()
+	defer g.presenceMu.Unlock()
+	g.spectators++
+}
+
+// Must be called with chansMu held
+func (g *conGame) spectatorLeft() {
+	g.presenceMu.Lock()
+	defer g.presenceMu.Unlock()
+	g.spectators--
+}
+
+func (g *conGame) spectatorCount() int {
+	g.presenceMu.Lock()
+	defer g.presenceMu.Unlock()
+	return g.spectators
+}
+
+// Subscribes to the game events as a spectator
+func (g *conGame) watch() chan gameEvent {
+	c := g.subscribe(subscriber{spectator: true})
+	g.spectatorsChanged()
+	return c
+}
+
+func (g *conGame) unwatch(c chan gameEvent) {
+	g.detach(c)
+	g.spectatorsChanged()
+}
+
+// Sends the state again so everyone sees the new spectator count
+func (g *conGame) spectatorsChanged() {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+	if g.state.result.Over() {
+		return
+	}
+	g.state.spectators = g.spectatorCount()
+	g.publish(g.state)
+}
+
+func (g *conGame) validateSpectatorToken(token string) error {
+	if g.spectatorToken != "" && token != g.spectatorToken {
+		return fmt.Errorf("invalid spectator token %v", token)
+	}
+	return nil
+}
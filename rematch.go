@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/luc527/go_checkers/core"
+)
+
+// The next game of a series, agreed on by both players once the previous one
+// is over
+type rematch struct {
+	id     uuid.UUID
+	series uuid.UUID
+	// Joins whoever played the given color in the previous game to this one,
+	// where they play the opposite color
+	join func(c *client, previous core.Color)
+}
+
+// Returns the series the game belongs to, making it the first game of a new
+// series if it's not part of one yet. Must be called with gameMu held.
+func (g *conGame) seriesOf(id uuid.UUID) uuid.UUID {
+	if g.series == uuid.Nil {
+		g.series = id
+	}
+	return g.series
+}
+
+func (g *conGame) supportsRematch() bool {
+	return g.newRematch != nil
+}
+
+func (g *conGame) validateRematch() error {
+	if !g.state.result.Over() {
+		return errors.New("rematch: game isn't over yet")
+	}
+	if !g.supportsRematch() {
+		return errors.New("rematch: not supported in this game")
+	}
+	if g.next != nil {
+		return errors.New("rematch: already started")
+	}
+	return nil
+}
+
+func (g *conGame) offerRematch(player core.Color) error {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+
+	if err := g.validateRematch(); err != nil {
+		return err
+	}
+	if g.rematchOffer != nil {
+		if *g.rematchOffer == player {
+			return errors.New("rematch: already offered")
+		}
+		// Both players want a rematch
+		return g.startRematchInner()
+	}
+	if g.machineOpponent {
+		return g.startRematchInner()
+	}
+	if g.playerPresence(player.Opposite()).connections == 0 {
+		return errors.New("rematch: opponent left")
+	}
+
+	g.rematchOffer = &player
+	g.publish(rematchMessageFrom("rematch/offer", player))
+	return nil
+}
+
+func (g *conGame) validateRematchAnswer(player core.Color) error {
+	if err := g.validateRematch(); err != nil {
+		return err
+	}
+	if g.rematchOffer == nil || *g.rematchOffer == player {
+		return errors.New("rematch: no offer from the opponent")
+	}
+	return nil
+}
+
+func (g *conGame) acceptRematch(player core.Color) error {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+
+	if err := g.validateRematchAnswer(player); err != nil {
+		return err
+	}
+	return g.startRematchInner()
+}
+
+func (g *conGame) declineRematch(player core.Color) error {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+
+	if err := g.validateRematchAnswer(player); err != nil {
+		return err
+	}
+	g.rematchOffer = nil
+	g.publish(rematchMessageFrom("rematch/decline", player))
+	return nil
+}
+
+func (g *conGame) startRematchInner() error {
+	next, err := g.newRematch()
+	if err != nil {
+		return err
+	}
+	g.rematchOffer = nil
+	g.next = next
+	close(g.rematched)
+	return nil
+}
+
+// The rematch both players agreed on, nil if there's none
+func (g *conGame) nextGame() *rematch {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+	return g.next
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// Limits how many searches run at the same time, so they don't compete for
+// the CPU and make time-limited searchers weaker. Searches waiting for a slot
+// are served one game at a time, so a game with many searches (e.g. hints)
+// doesn't hold up the others.
+type searchScheduler struct {
+	// Points to the maximum number of searches running at the same time,
+	// read when needed since flags are parsed after the scheduler is created
+	workers *int
+
+	mu      sync.Mutex
+	running int
+	// Waiting searches of each game, in order
+	waiting map[*conGame][]*searchTicket
+	// Games with waiting searches, the next one to be served first
+	order []*conGame
+}
+
+type searchTicket struct {
+	// Closed once the search can run
+	ready chan struct{}
+	// Told the number of searches that will run before this one whenever
+	// it changes, may be nil
+	queued func(ahead int)
+	ahead  int
+}
+
+var scheduler = newSearchScheduler(searchWorkers)
+
+func newSearchScheduler(workers *int) *searchScheduler {
+	return &searchScheduler{
+		workers: workers,
+		waiting: make(map[*conGame][]*searchTicket),
+	}
+}
+
+func (s *searchScheduler) limit() int {
+	return max(*s.workers, 1)
+}
+
+// Waits for a slot to run a search for the game, returning the function that
+// frees it once the search is done, or an error if the context is done first
+func (s *searchScheduler) acquire(ctx context.Context, g *conGame, queued func(ahead int)) (func(), error) {
+	s.mu.Lock()
+	if s.running < s.limit() && len(s.order) == 0 {
+		s.running++
+		s.mu.Unlock()
+		return s.release, nil
+	}
+	t := &searchTicket{ready: make(chan struct{}), queued: queued, ahead: -1}
+	if len(s.waiting[g]) == 0 {
+		s.order = append(s.order, g)
+	}
+	s.waiting[g] = append(s.waiting[g], t)
+	s.updateQueuedInner()
+	s.mu.Unlock()
+
+	select {
+	case <-t.ready:
+		return s.release, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-t.ready:
+			// Got the slot just now, give it to someone else
+			s.releaseInner()
+		default:
+			s.removeInner(g, t)
+			s.updateQueuedInner()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (s *searchScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseInner()
+}
+
+// Hands the slot over to the next waiting search, if any
+func (s *searchScheduler) releaseInner() {
+	if len(s.order) == 0 {
+		s.running--
+		return
+	}
+	g := s.order[0]
+	t := s.waiting[g][0]
+	s.removeInner(g, t)
+	// The game goes to the end of the line
+	if len(s.waiting[g]) > 0 {
+		s.order = append(slices.DeleteFunc(s.order, func(o *conGame) bool { return o == g }), g)
+	}
+	close(t.ready)
+	s.updateQueuedInner()
+}
+
+func (s *searchScheduler) removeInner(g *conGame, t *searchTicket) {
+	tickets := slices.DeleteFunc(s.waiting[g], func(o *searchTicket) bool { return o == t })
+	if len(tickets) == 0 {
+		delete(s.waiting, g)
+		s.order = slices.DeleteFunc(s.order, func(o *conGame) bool { return o == g })
+	} else {
+		s.waiting[g] = tickets
+	}
+}
+
+// Tells the waiting searches how many will run before them, in the order
+// they're going to be served: the first search of each game, then the
+// second, and so on
+func (s *searchScheduler) updateQueuedInner() {
+	ahead := 0
+	for round := 0; ; round++ {
+		served := false
+		for _, g := range s.order {
+			tickets := s.waiting[g]
+			if round >= len(tickets) {
+				continue
+			}
+			served = true
+			if t := tickets[round]; t.ahead != ahead {
+				t.ahead = ahead
+				if t.queued != nil {
+					t.queued(ahead)
+				}
+			}
+			ahead++
+		}
+		if !served {
+			return
+		}
+	}
+}
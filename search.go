@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"math/rand"
+	"slices"
+	"time"
+
+	"github.com/luc527/go_checkers/core"
+	"github.com/luc527/go_checkers/minimax"
+)
+
+const (
+	maxDepthLimit = 12
+	maxNodeLimit  = 10_000_000
+	// How often the search checks whether it should stop, in nodes
+	cancelCheckInterval = 64
+)
+
+// Searches the game tree up to a fixed depth, or a fixed number of nodes, or
+// both. Unlike the searchers in the minimax package it doesn't depend on how
+// fast the machine is, nor does it shuffle the plies unless told to, so the
+// same position always gets the same ply.
+type fixedSearcher struct {
+	ToMax core.Color
+	minimax.Heuristic
+	// Zero for no limit, but at least one of the limits must be set, unless
+	// the search is given a context with a deadline
+	DepthLimit int
+	NodeLimit  int
+	// Whether to try the plies in a random order, so equally good plies are
+	// picked at random, like the minimax searchers do
+	shuffle bool
+}
+
+// State of one search, shared by the iterations of iterative deepening
+type fixedSearch struct {
+	fixedSearcher
+	ctx   context.Context
+	nodes int
+	// Set once the node limit is reached
+	aborted bool
+	// Whether the depth limit cut off some node in the current iteration,
+	// otherwise the whole game tree was searched
+	cutoff bool
+	// Triangular array of principal variations: pv[height] is the one found
+	// for the node that many plies below the root, reused between nodes so
+	// the search doesn't allocate a new one for each
+	pv [][]core.Ply
+	// Called with the result of the last finished iteration every
+	// thoughtProgressInterval, if not nil
+	progress     func(thought)
+	best         thought
+	lastProgress time.Time
+}
+
+func (s fixedSearcher) Search(g *core.Game) core.Ply {
+	return s.searchContext(context.Background(), g)
+}
+
+// Stops searching once the context is done, returning the best ply found so far
+func (s fixedSearcher) searchContext(ctx context.Context, g *core.Game) core.Ply {
+	return s.think(ctx, g, nil).ply
+}
+
+func (s fixedSearcher) think(ctx context.Context, g *core.Game, progress func(thought)) thought {
+	search := &fixedSearch{
+		fixedSearcher: s,
+		ctx:           ctx,
+		progress:      progress,
+		best:          thought{source: searchSource},
+		lastProgress:  time.Now(),
+	}
+
+	// Without a node limit, iterative deepening would only waste time, unless
+	// the search is limited by the context's deadline alone or its progress
+	// is reported
+	depth := 1
+	if s.NodeLimit == 0 && s.DepthLimit > 0 && progress == nil {
+		depth = s.DepthLimit
+	}
+
+	for ; s.DepthLimit == 0 || depth <= s.DepthLimit; depth++ {
+		search.cutoff = false
+		value := search.search(g, 0, depth, math.Inf(-1), math.Inf(1))
+		pv := slices.Clone(search.pv[0])
+		if search.aborted {
+			// An interrupted iteration may have missed better plies, so it's
+			// only used if no iteration got to finish
+			if search.best.ply == nil && len(pv) > 0 {
+				search.best.ply = pv[0]
+			}
+			break
+		}
+		if len(pv) > 0 {
+			search.best = thought{
+				ply:    pv[0],
+				source: searchSource,
+				score:  &value,
+				depth:  depth,
+				pv:     pv,
+			}
+		}
+		if !search.cutoff {
+			break
+		}
+	}
+
+	if search.best.ply == nil {
+		if plies := g.Plies(); len(plies) > 0 {
+			search.best.ply = plies[0]
+		}
+	}
+	search.best.nodes = search.nodes
+	return search.best
+}
+
+// Returns the value of the game, leaving the principal variation, the plies
+// both players are expected to play from here, in pv[height]
+func (s *fixedSearch) search(g *core.Game, height int, depth int, alpha float64, beta float64) float64 {
+	if height == len(s.pv) {
+		s.pv = append(s.pv, nil)
+	}
+	s.pv[height] = s.pv[height][:0]
+
+	s.nodes++
+	if s.NodeLimit > 0 && s.nodes > s.NodeLimit {
+		s.aborted = true
+	} else if s.nodes%cancelCheckInterval == 0 {
+		if s.ctx.Err() != nil {
+			s.aborted = true
+		} else if s.progress != nil && time.Since(s.lastProgress) >= thoughtProgressInterval {
+			s.lastProgress = time.Now()
+			progress := s.best
+			progress.nodes = s.nodes
+			s.progress(progress)
+		}
+	}
+	if s.aborted {
+		return 0
+	}
+
+	res := g.Result()
+	if res.Over() {
+		if !res.HasWinner() {
+			return drawValue
+		} else if res.Winner() == s.ToMax {
+			return winValue
+		} else {
+			return lossValue
+		}
+	}
+	if depth <= 0 {
+		s.cutoff = true
+		return s.Heuristic(g.Board(), s.ToMax)
+	}
+
+	maximizeTurn := g.ToPlay() == s.ToMax
+
+	value := math.Inf(1)
+	if maximizeTurn {
+		value = math.Inf(-1)
+	}
+
+	plies := g.Plies()
+	if s.shuffle {
+		// Shuffled in a copy, since the game caches its plies
+		plies = slices.Clone(plies)
+		rand.Shuffle(len(plies), func(i, j int) {
+			plies[i], plies[j] = plies[j], plies[i]
+		})
+	}
+	for _, ply := range plies {
+		undoInfo, err := g.DoPly(ply)
+		if err != nil {
+			continue
+		}
+		subValue := s.search(g, height+1, depth-1, alpha, beta)
+		g.UndoPly(undoInfo)
+		if s.aborted {
+			break
+		}
+
+		if maximizeTurn && subValue > value {
+			value = subValue
+			s.pv[height] = append(append(s.pv[height][:0], ply), s.pv[height+1]...)
+			alpha = math.Max(alpha, subValue)
+		} else if !maximizeTurn && subValue < value {
+			value = subValue
+			s.pv[height] = append(append(s.pv[height][:0], ply), s.pv[height+1]...)
+			beta = math.Min(beta, subValue)
+		}
+		if alpha >= beta {
+			break
+		}
+	}
+
+	return value
+}
+
+// A searcher that picks some plies itself, without searching, and leaves the
+// other positions to the searcher it wraps
+type searcherWrapper interface {
+	minimax.Searcher
+	// The ply it picks and where it came from, nil if it leaves the position
+	// to the wrapped searcher
+	pick(g *core.Game) (core.Ply, string)
+	unwrap() minimax.Searcher
+	// The same wrapper around another searcher
+	with(inner minimax.Searcher) minimax.Searcher
+}
+
+// Searches with the given searcher, stopping as soon as the context is done.
+// Returns the context's error if it was done before the search finished.
+func searchContext(ctx context.Context, searcher minimax.Searcher, g *core.Game) (core.Ply, error) {
+	t, err := think(ctx, searcher, g, nil)
+	return t.ply, err
+}
+
+// Like searchContext, but also tells what the searcher thought of the
+// position, as far as it can tell. Progress is reported while searching when
+// given, for the searchers that can be stopped.
+func think(ctx context.Context, searcher minimax.Searcher, g *core.Game, progress func(thought)) (thought, error) {
+	var t thought
+	switch s := searcher.(type) {
+	case fixedSearcher:
+		t = s.think(ctx, g, progress)
+	case searcherWrapper:
+		if t.ply, t.source = s.pick(g); t.ply == nil {
+			return think(ctx, s.unwrap(), g, progress)
+		}
+	// The minimax searchers can't be stopped, so the same searches are done
+	// by a fixed searcher instead
+	case minimax.DepthLimitedSearcher:
+		t = fixedSearcher{
+			ToMax:      s.ToMax,
+			Heuristic:  s.Heuristic,
+			DepthLimit: s.DepthLimit,
+			shuffle:    true,
+		}.think(ctx, g, progress)
+	case minimax.TimeLimitedSearcher:
+		timeCtx, cancel := context.WithTimeout(ctx, timeLimitOf(s))
+		defer cancel()
+		t = fixedSearcher{
+			ToMax:     s.ToMax,
+			Heuristic: s.Heuristic,
+			shuffle:   true,
+		}.think(timeCtx, g, progress)
+	default:
+		// Can't be stopped
+		log.Printf("think: unknown searcher %T", searcher)
+		t = thought{ply: searcher.Search(g), source: searchSource}
+	}
+	if err := ctx.Err(); err != nil {
+		return thought{}, err
+	}
+	return t, nil
+}
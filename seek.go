@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sync"
+
+	"github.com/luc527/go_checkers/core"
+)
+
+// A client waiting in the matchmaking queue
+type seeker struct {
+	// Receives the game once the seeker is paired
+	matched chan seekMatch
+}
+
+type seekMatch struct {
+	// nil if the game couldn't be created
+	game  *humanGame
+	color core.Color
+}
+
+var (
+	seekMu sync.Mutex
+	// Seekers waiting for an opponent, by the time control they want to play
+	seekers = make(map[timeControl][]*seeker)
+)
+
+// Takes the longest waiting seeker for the time control out of the queue, if
+// there is one
+func popSeeker(tc timeControl) *seeker {
+	seekMu.Lock()
+	defer seekMu.Unlock()
+	queue := seekers[tc]
+	if len(queue) == 0 {
+		return nil
+	}
+	s := queue[0]
+	if len(queue) == 1 {
+		delete(seekers, tc)
+	} else {
+		seekers[tc] = queue[1:]
+	}
+	return s
+}
+
+func pushSeeker(tc timeControl, s *seeker) {
+	seekMu.Lock()
+	defer seekMu.Unlock()
+	seekers[tc] = append(seekers[tc], s)
+}
+
+// Takes the seeker out of the queue, returns false if it was already paired
+func removeSeeker(tc timeControl, s *seeker) bool {
+	seekMu.Lock()
+	defer seekMu.Unlock()
+	queue := seekers[tc]
+	for i, other := range queue {
+		if other == s {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			if len(queue) == 0 {
+				delete(seekers, tc)
+			} else {
+				seekers[tc] = queue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (c *client) seekHumanGame(data seekData) {
+	opts, err := defaultGameOptions()
+	if err != nil {
+		c.err(err)
+		return
+	}
+	if data.TimeControl != nil {
+		tc, err := data.TimeControl.timeControl()
+		if err != nil {
+			c.err(err)
+			return
+		}
+		opts.timeControl = tc
+	}
+	tc := opts.timeControl
+
+	if opponent := popSeeker(tc); opponent != nil {
+		hg, err := newHumanGame(opts)
+		if err == nil {
+			err = registerHumanGame(hg)
+		}
+		if err != nil {
+			opponent.matched <- seekMatch{}
+			c.err(err)
+			return
+		}
+
+		// Neither seeker gets to pick, so the colors are drawn
+		color := whiteColor
+		if rand.Intn(2) == 0 {
+			color = blackColor
+		}
+		opponent.matched <- seekMatch{game: hg, color: color.Opposite()}
+		c.joinHumanGame(hg, color)
+		return
+	}
+
+	s := &seeker{matched: make(chan seekMatch, 1)}
+	pushSeeker(tc, s)
+	c.trySend(seekingMessageFrom())
+
+	for {
+		select {
+		case match := <-s.matched:
+			if match.game == nil {
+				c.error("failed to create the matched game")
+				return
+			}
+			c.joinHumanGame(match.game, match.color)
+			return
+		case bs, ok := <-c.incoming:
+			if !ok {
+				if !removeSeeker(tc, s) {
+					// Paired right as the connection closed, the game will be
+					// abandoned by the player who never showed up
+					<-s.matched
+				}
+				return
+			}
+			var envelope messageEnvelope
+			if err := json.Unmarshal(bs, &envelope); err != nil {
+				c.err(err)
+				continue
+			}
+			c.errorf("can't send %q messages while seeking a game", envelope.Type)
+		}
+	}
+}
@@ -82,7 +82,35 @@ func tryColor(t *testing.T, c string) core.Color {
 	return 0
 }
 
+// Abandons the games the test left running once it's done, so their machine
+// players don't compete with later tests for the search scheduler
+func abandonGamesAfter(t *testing.T) {
+	t.Cleanup(func() {
+		var games []*conGame
+		machMu.Lock()
+		for _, mg := range machGames {
+			games = append(games, mg.conGame)
+		}
+		machMu.Unlock()
+		humanMu.Lock()
+		for _, hg := range humanGames {
+			games = append(games, hg.conGame)
+		}
+		humanMu.Unlock()
+		exhibitionMu.Lock()
+		for _, eg := range exhibitionGames {
+			games = append(games, eg.conGame)
+		}
+		exhibitionMu.Unlock()
+
+		for _, g := range games {
+			g.abandonIfIdle(0)
+		}
+	})
+}
+
 func getClientAndConn(t *testing.T) (client *client, conn *websocket.Conn) {
+	abandonGamesAfter(t)
 	upgrader := websocket.Upgrader{}
 	var wg sync.WaitGroup
 	var err error
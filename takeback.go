@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/luc527/go_checkers/core"
+)
+
+type takebackRequest struct {
+	by    core.Color
+	plies int
+}
+
+// Rebuilds the game by replaying the given plies from the initial position
+func replayGame(start *startPosition, noProgressLimit int, history []core.Ply) (*core.Game, error) {
+	g := start.newGame(noProgressLimit)
+	for i, ply := range history {
+		if _, err := g.DoPly(ply); err != nil {
+			return nil, fmt.Errorf("replay ply %d: %v", i, err)
+		}
+	}
+	return g, nil
+}
+
+func (g *conGame) requestTakeback(player core.Color, plies int) error {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+	if g.state.result.Over() {
+		return errors.New("request takeback: game already over")
+	}
+	if g.takeback != nil {
+		return errors.New("request takeback: there's already a pending request")
+	}
+	if n := len(g.plyHistory); plies < 1 || plies > n {
+		return fmt.Errorf("request takeback: can't take back %d plies, there are %d", plies, n)
+	}
+	req := &takebackRequest{by: player, plies: plies}
+	if g.machineOpponent {
+		if m, n := g.machineTakebackPlies(req), len(g.plyHistory); m > n {
+			return fmt.Errorf("request takeback: the machine would take back %d plies to put you back on move, there are %d", m, n)
+		}
+	}
+	g.takeback = req
+	g.state.takeback = g.takeback
+	g.registerActivity()
+	g.publish(g.state)
+	return nil
+}
+
+// The machine always accepts, taking back one more ply than asked for when
+// needed so that the requester ends up on move.
+// Must be called with gameMu held.
+func (g *conGame) machineTakebackPlies(req *takebackRequest) int {
+	plies := req.plies
+	requesterToPlay := g.game.ToPlay() == req.by
+	if requesterToPlay != (plies%2 == 0) {
+		plies++
+	}
+	return plies
+}
+
+// Must be called with gameMu held
+func (g *conGame) validateTakebackAnswer(player core.Color) error {
+	if g.state.result.Over() {
+		return errors.New("game already over")
+	}
+	if g.takeback == nil || g.takeback.by == player {
+		return errors.New("no takeback request from the opponent")
+	}
+	return nil
+}
+
+func (g *conGame) acceptTakeback(player core.Color) error {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+	if err := g.validateTakebackAnswer(player); err != nil {
+		return fmt.Errorf("accept takeback: %v", err)
+	}
+	if err := g.rollbackInner(g.takeback.plies); err != nil {
+		return fmt.Errorf("accept takeback: %v", err)
+	}
+	return nil
+}
+
+func (g *conGame) declineTakeback(player core.Color) error {
+	g.gameMu.Lock()
+	defer g.gameMu.Unlock()
+	if err := g.validateTakebackAnswer(player); err != nil {
+		return fmt.Errorf("decline takeback: %v", err)
+	}
+	g.clearTakebackInner()
+	return nil
+}
+
+// Must be called with gameMu held
+func (g *conGame) clearTakebackInner() {
+	g.takeback = nil
+	g.state.takeback = nil
+	g.registerActivity()
+	g.publish(g.state)
+}
+
+// Undoes the last plies, rebuilding the game from the ply history.
+// Must be called with gameMu held.
+func (g *conGame) rollbackInner(plies int) error {
+	g.plyHistoryMu.Lock()
+	defer g.plyHistoryMu.Unlock()
+
+	n := len(g.plyHistory)
+	if plies < 1 || plies > n {
+		return fmt.Errorf("rollback: can't undo %d plies, there are %d", plies, n)
+	}
+	history := g.plyHistory[:n-plies]
+	game, err := replayGame(g.opts.start, g.opts.noProgressLimit, history)
+	if err != nil {
+		return fmt.Errorf("rollback: %v", err)
+	}
+
+	g.game = game
+	g.plyHistory = history
+	g.positions.truncate(len(history))
+	g.drawOffer = nil
+	g.takeback = nil
+
+	if g.clock != nil {
+		now := time.Now()
+		g.clock.restartTurn(now, game.ToPlay())
+		g.clock.arm(now, g.flagFall)
+	}
+
+	g.updateState()
+	g.registerActivity()
+	g.publish(g.state)
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"time"
+
+	"github.com/luc527/go_checkers/core"
+)
+
+// How often a running search reports its progress, when the game asks for it
+const thoughtProgressInterval = 500 * time.Millisecond
+
+// Where the machine's ply came from
+const (
+	searchSource  = "search"
+	bookSource    = "book"
+	endgameSource = "endgame"
+	// Played on purpose instead of the best ply, by the easier levels
+	blunderSource = "blunder"
+)
+
+// What the machine thought of the position when choosing its ply
+type thought struct {
+	ply    core.Ply
+	source string
+	// From the machine's point of view, nil when the ply wasn't searched for
+	score *float64
+	// Deepest search iteration that finished
+	depth int
+	nodes int
+	// Principal variation: the plies the machine expects to be played, its
+	// own first
+	pv []core.Ply
+}
+
+// Plies the endgame table would play for both players, nil if it doesn't
+// cover the position. Draws have no end to follow, so only their first ply is
+// given.
+func (t *endgameTable) think(g *core.Game, specialPlies int) (thought, bool) {
+	v, ok := t.probe(g, specialPlies)
+	if !ok {
+		return thought{}, false
+	}
+
+	score := float64(drawValue)
+	if v.winner != nil && *v.winner == g.ToPlay() {
+		score = winValue
+	} else if v.winner != nil {
+		score = lossValue
+	}
+
+	g = g.Copy()
+	var pv []core.Ply
+	for len(pv) < max(v.plies, 1) {
+		ply := t.bestPly(g, specialPlies)
+		if ply == nil {
+			break
+		}
+		pv = append(pv, ply)
+		if _, err := g.DoPly(ply); err != nil {
+			break
+		}
+		specialPlies = nextSpecialPlies(g.Board(), specialPlies)
+	}
+	if len(pv) == 0 {
+		return thought{}, false
+	}
+	return thought{
+		ply:    pv[0],
+		source: endgameSource,
+		score:  &score,
+		depth:  len(pv),
+		pv:     pv,
+	}, true
+}
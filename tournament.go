@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/google/uuid"
+	"github.com/luc527/go_checkers/core"
+	"github.com/luc527/go_checkers/minimax"
+)
+
+const (
+	// Rating the estimates are centered around
+	baseElo = 1500
+	// Scores are kept away from 0% and 100%, which would give infinite ratings
+	minEloScore   = 0.01
+	eloIterations = 50
+)
+
+type tournamentPlayer struct {
+	name      string
+	searcher  minimax.Searcher
+	heuristic minimax.Heuristic
+}
+
+type tournamentGame struct {
+	Id     uuid.UUID       `json:"id"`
+	White  string          `json:"white"`
+	Black  string          `json:"black"`
+	Result core.GameResult `json:"result"`
+}
+
+// Round robin between machine players, where every pair of players plays a
+// number of games alternating colors
+type tournament struct {
+	id      uuid.UUID
+	players []tournamentPlayer
+	// Games each pair of players plays against each other
+	gamesPerPairing int
+
+	mu sync.Mutex
+	// score[i][j] is how much player i scored against player j, 1 per win and
+	// 0.5 per draw; games[i][j] is how many games they played
+	score [][]float64
+	games [][]int
+	log   []tournamentGame
+	done  bool
+}
+
+var (
+	tournamentMu = sync.Mutex{}
+	tournaments  = make(map[uuid.UUID]*tournament)
+)
+
+func newTournament(players []tournamentPlayer, gamesPerPairing int) (*tournament, error) {
+	if len(players) < 2 {
+		return nil, errors.New("tournament: needs at least two players")
+	}
+	if gamesPerPairing <= 0 {
+		return nil, errors.New("tournament: games per pairing must be positive")
+	}
+	for i, p := range players {
+		for _, other := range players[:i] {
+			if p.name == other.name {
+				return nil, fmt.Errorf("tournament: duplicate player name %q", p.name)
+			}
+		}
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	t := &tournament{
+		id:              id,
+		players:         players,
+		gamesPerPairing: gamesPerPairing,
+		score:           make([][]float64, len(players)),
+		games:           make([][]int, len(players)),
+	}
+	for i := range players {
+		t.score[i] = make([]float64, len(players))
+		t.games[i] = make([]int, len(players))
+	}
+	return t, nil
+}
+
+func (t *tournament) totalGames() int {
+	n := len(t.players)
+	return n * (n - 1) / 2 * t.gamesPerPairing
+}
+
+// Plays all the games of the tournament, one at a time so every searcher gets
+// the same share of the CPU
+func (t *tournament) run(db store) {
+	for i := range t.players {
+		for j := i + 1; j < len(t.players); j++ {
+			for k := 0; k < t.gamesPerPairing; k++ {
+				white, black := i, j
+				if k%2 == 1 {
+					white, black = j, i
+				}
+				t.play(db, white, black)
+			}
+		}
+	}
+
+	t.mu.Lock()
+	t.done = true
+	t.mu.Unlock()
+}
+
+func (t *tournament) play(db store, white int, black int) {
+	opts, err := defaultGameOptions()
+	if err != nil {
+		log.Printf("tournament %v: %v", t.id, err)
+		return
+	}
+	id, err := uuid.NewRandom()
+	if err != nil {
+		log.Printf("tournament %v: failed to generate game id: %v", t.id, err)
+		return
+	}
+
+	players := [2]machinePlayer{
+		whiteColor: t.players[white].machinePlayer(whiteColor),
+		blackColor: t.players[black].machinePlayer(blackColor),
+	}
+	g := playMachineGame(players, opts)
+	s := g.current()
+	result := s.result
+
+	tournamentId := t.id
+	record := g.record()
+	record.Tournament = &tournamentId
+	if err := saveGameRecord(db, tournamentMode, id, record); err != nil {
+		log.Printf("tournament %v: failed to save game %v: %v", t.id, id, err)
+	}
+	getAndNotifyWebhooks(db, tournamentMode, id, s)
+
+	var whiteScore float64
+	switch result {
+	case core.WhiteWonResult:
+		whiteScore = 1
+	case core.DrawResult:
+		whiteScore = 0.5
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.score[white][black] += whiteScore
+	t.score[black][white] += 1 - whiteScore
+	t.games[white][black]++
+	t.games[black][white]++
+	t.log = append(t.log, tournamentGame{
+		Id:     id,
+		White:  t.players[white].name,
+		Black:  t.players[black].name,
+		Result: result,
+	})
+}
+
+func (p tournamentPlayer) machinePlayer(color core.Color) machinePlayer {
+	return newMachinePlayer(color, p.searcher, p.heuristic)
+}
+
+// Plays a whole game between the machine players, like an exhibition game
+// nobody watches, returning it once it's over
+func playMachineGame(players [2]machinePlayer, opts gameOptions) *conGame {
+	g := newConGame(opts)
+	events := g.channel()
+	for _, p := range players {
+		go p.run(g)
+	}
+	for ev := range events {
+		if s, ok := ev.(gameState); ok && s.result.Over() {
+			break
+		}
+	}
+	g.detachDraining(events)
+	return g
+}
+
+type crosstableRow struct {
+	Name   string  `json:"name"`
+	Games  int     `json:"games"`
+	Wins   int     `json:"wins"`
+	Draws  int     `json:"draws"`
+	Losses int     `json:"losses"`
+	Score  float64 `json:"score"`
+	Elo    float64 `json:"elo"`
+	// Score against each opponent, by name
+	Against map[string]float64 `json:"against"`
+}
+
+type tournamentStatus struct {
+	Id         uuid.UUID        `json:"id"`
+	Done       bool             `json:"done"`
+	Played     int              `json:"played"`
+	Total      int              `json:"total"`
+	Crosstable []crosstableRow  `json:"crosstable"`
+	Games      []tournamentGame `json:"games"`
+}
+
+func (t *tournament) status() tournamentStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	elo := estimateElo(t.score, t.games)
+	rows := make([]crosstableRow, len(t.players))
+	for i, p := range t.players {
+		row := crosstableRow{
+			Name:    p.name,
+			Elo:     math.Round(elo[i]),
+			Against: make(map[string]float64),
+		}
+		for j, opp := range t.players {
+			if i == j {
+				continue
+			}
+			row.Games += t.games[i][j]
+			row.Score += t.score[i][j]
+			row.Against[opp.name] = t.score[i][j]
+		}
+		rows[i] = row
+	}
+	for _, g := range t.log {
+		white := slices.IndexFunc(rows, func(r crosstableRow) bool { return r.Name == g.White })
+		black := slices.IndexFunc(rows, func(r crosstableRow) bool { return r.Name == g.Black })
+		switch g.Result {
+		case core.WhiteWonResult:
+			rows[white].Wins++
+			rows[black].Losses++
+		case core.BlackWonResult:
+			rows[black].Wins++
+			rows[white].Losses++
+		default:
+			rows[white].Draws++
+			rows[black].Draws++
+		}
+	}
+	slices.SortStableFunc(rows, func(a, b crosstableRow) int {
+		switch {
+		case a.Score > b.Score:
+			return -1
+		case a.Score < b.Score:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	return tournamentStatus{
+		Id:         t.id,
+		Done:       t.done,
+		Played:     len(t.log),
+		Total:      t.totalGames(),
+		Crosstable: rows,
+		Games:      slices.Clone(t.log),
+	}
+}
+
+// Estimates the players' ratings from their results against each other, by
+// repeatedly taking each player's performance rating against the current
+// estimates of their opponents
+func estimateElo(score [][]float64, games [][]int) []float64 {
+	n := len(score)
+	elo := make([]float64, n)
+	for i := range elo {
+		elo[i] = baseElo
+	}
+
+	for it := 0; it < eloIterations; it++ {
+		next := make([]float64, n)
+		for i := 0; i < n; i++ {
+			var played int
+			var scored, opponents float64
+			for j := 0; j < n; j++ {
+				played += games[i][j]
+				scored += score[i][j]
+				opponents += float64(games[i][j]) * elo[j]
+			}
+			if played == 0 {
+				next[i] = elo[i]
+				continue
+			}
+			p := scored / float64(played)
+			p = math.Max(minEloScore, math.Min(1-minEloScore, p))
+			performance := opponents/float64(played) + 400*math.Log10(p/(1-p))
+			// Moving only halfway keeps the estimates from oscillating
+			next[i] = (elo[i] + performance) / 2
+		}
+
+		// Only differences between ratings mean anything, so keep them centered
+		var mean float64
+		for _, r := range next {
+			mean += r
+		}
+		mean /= float64(n)
+		for i := range next {
+			next[i] += baseElo - mean
+		}
+		elo = next
+	}
+	return elo
+}
+
+// Player in the tournament configuration
+type tournamentEntryData struct {
+	// Defaults to a description of the engine settings
+	Name string `json:"name"`
+	searcherData
+}
+
+type tournamentData struct {
+	Entries         []tournamentEntryData `json:"entries"`
+	GamesPerPairing int                   `json:"gamesPerPairing"`
+}
+
+func (d tournamentData) tournament() (*tournament, error) {
+	players := make([]tournamentPlayer, 0, len(d.Entries))
+	for _, e := range d.Entries {
+		searcher, heuristic, err := e.searcher()
+		if err != nil {
+			return nil, fmt.Errorf("tournament: %v", err)
+		}
+		name := e.Name
+		if name == "" {
+			name = e.describe()
+		}
+		players = append(players, tournamentPlayer{
+			name:      name,
+			searcher:  searcher,
+			heuristic: heuristic,
+		})
+	}
+	games := d.GamesPerPairing
+	if games == 0 {
+		games = 2
+	}
+	return newTournament(players, games)
+}
+
+func startTournament(t *tournament) {
+	tournamentMu.Lock()
+	tournaments[t.id] = t
+	tournamentMu.Unlock()
+
+	go t.run(db)
+}
+
+func handlePostTournament(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var data tournamentData
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeJsonError(w, http.StatusBadRequest, "invalid tournament configuration")
+		return
+	}
+	t, err := data.tournament()
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	startTournament(t)
+
+	bytes, err := json.Marshal(t.status())
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, "json encode failed")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	if _, err := w.Write(bytes); err != nil {
+		log.Printf("failed to write tournament response: %v", err)
+	}
+}
+
+func handleGetTournament(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := uuid.Parse(r.URL.Query().Get("id"))
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, "invalid uuid")
+		return
+	}
+
+	tournamentMu.Lock()
+	t := tournaments[id]
+	tournamentMu.Unlock()
+
+	if t == nil {
+		writeJsonError(w, http.StatusNotFound, "tournament not found")
+		return
+	}
+
+	bytes, err := json.Marshal(t.status())
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, "json encode failed")
+		return
+	}
+
+	if _, err := w.Write(bytes); err != nil {
+		writeJsonError(w, http.StatusInternalServerError, "response body write failed")
+	}
+}
+
+// Runs a tournament from the command line, with players given as
+// heuristic:timeLimitMs[:name] or as a difficulty level, and prints the
+// crosstable once it's over
+func runTournamentCommand(args []string) {
+	fs := flag.NewFlagSet("tournament", flag.ExitOnError)
+	games := fs.Int("games", 2, "games each pair of players plays against each other, alternating colors")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %v tournament [-games n] (heuristic:timeLimitMs[:name] | level)...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	data := tournamentData{GamesPerPairing: *games}
+	for _, arg := range fs.Args() {
+		parts := strings.Split(arg, ":")
+		if len(parts) == 1 {
+			data.Entries = append(data.Entries, tournamentEntryData{
+				searcherData: searcherData{Level: arg},
+			})
+			continue
+		}
+		if len(parts) > 3 {
+			log.Fatalf("invalid player %q", arg)
+		}
+		ms, err := strconv.Atoi(parts[1])
+		if err != nil {
+			log.Fatalf("invalid time limit in %q: %v", arg, err)
+		}
+		entry := tournamentEntryData{
+			searcherData: searcherData{Heuristic: parts[0], TimeLimitMs: ms},
+		}
+		if len(parts) == 3 {
+			entry.Name = parts[2]
+		}
+		data.Entries = append(data.Entries, entry)
+	}
+
+	t, err := data.tournament()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("running tournament %v (%d games)", t.id, t.totalGames())
+	t.run(db)
+
+	printCrosstable(os.Stdout, t.status())
+}
+
+func printCrosstable(out io.Writer, s tournamentStatus) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprint(w, "#\tplayer\tscore\tgames\t+\t=\t-\telo")
+	for _, row := range s.Crosstable {
+		fmt.Fprintf(w, "\t%v", row.Name)
+	}
+	fmt.Fprintln(w)
+	for i, row := range s.Crosstable {
+		fmt.Fprintf(w, "%d\t%v\t%v\t%d\t%d\t%d\t%d\t%v", i+1, row.Name, row.Score, row.Games, row.Wins, row.Draws, row.Losses, row.Elo)
+		for _, opp := range s.Crosstable {
+			if opp.Name == row.Name {
+				fmt.Fprint(w, "\t-")
+			} else {
+				fmt.Fprintf(w, "\t%v", row.Against[opp.Name])
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
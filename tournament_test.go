@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/luc527/go_checkers/minimax"
+)
+
+func TestEstimateElo(t *testing.T) {
+	score := [][]float64{
+		{0, 3},
+		{1, 0},
+	}
+	games := [][]int{
+		{0, 4},
+		{4, 0},
+	}
+	elo := estimateElo(score, games)
+
+	// Scoring 75% means being about 191 points stronger
+	if diff := elo[0] - elo[1]; math.Abs(diff-400*math.Log10(3)) > 1 {
+		t.Fatalf("expected a difference of about 191, got %v", diff)
+	}
+	if mean := (elo[0] + elo[1]) / 2; math.Abs(mean-baseElo) > 1e-6 {
+		t.Fatalf("expected ratings centered at %v, got %v", baseElo, mean)
+	}
+
+	// A perfect score doesn't give an infinite rating
+	elo = estimateElo([][]float64{{0, 2}, {0, 0}}, [][]int{{0, 2}, {2, 0}})
+	if math.IsInf(elo[0], 0) || math.IsNaN(elo[0]) || elo[0] <= elo[1] {
+		t.Fatalf("unexpected ratings for a perfect score %v", elo)
+	}
+}
+
+func TestTournament(t *testing.T) {
+	player := func(name string, h minimax.Heuristic) tournamentPlayer {
+		return tournamentPlayer{
+			name:      name,
+			searcher:  minimax.DepthLimitedSearcher{Heuristic: h, DepthLimit: 1},
+			heuristic: h,
+		}
+	}
+	players := []tournamentPlayer{
+		player("weighted", minimax.WeightedCountHeuristic),
+		player("unweighted", minimax.UnweightedCountHeuristic),
+	}
+
+	if _, err := newTournament(players[:1], 2); err == nil {
+		t.Fatal("a tournament needs at least two players")
+	}
+	if _, err := newTournament([]tournamentPlayer{players[0], players[0]}, 2); err == nil {
+		t.Fatal("player names should be unique")
+	}
+
+	tour, err := newTournament(players, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memStore{}
+	tour.run(store)
+
+	s := tour.status()
+	if !s.Done || s.Played != 2 || s.Total != 2 {
+		t.Fatalf("expected the 2 games to be played, got %+v", s)
+	}
+	if s.Games[0].White != s.Games[1].Black || s.Games[0].Black != s.Games[1].White {
+		t.Fatalf("expected colors to alternate, got %+v", s.Games)
+	}
+	var total float64
+	for _, row := range s.Crosstable {
+		total += row.Score
+		if row.Games != 2 || row.Wins+row.Draws+row.Losses != 2 {
+			t.Fatalf("unexpected crosstable row %+v", row)
+		}
+	}
+	if total != 2 {
+		t.Fatalf("expected the scores to add up to the games played, got %v", total)
+	}
+
+	for _, g := range s.Games {
+		record, err := getGameRecord(store, tournamentMode, g.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Tournament == nil || *record.Tournament != tour.id || record.Result != g.Result {
+			t.Fatalf("game %v wasn't stored as part of the tournament", g.Id)
+		}
+	}
+
+	var out bytes.Buffer
+	printCrosstable(&out, s)
+	if !strings.Contains(out.String(), "weighted") || !strings.Contains(out.String(), "unweighted") {
+		t.Fatalf("crosstable is missing players:\n%v", out.String())
+	}
+}
+
+func TestTournamentHandlers(t *testing.T) {
+	rec := httptest.NewRecorder()
+	body := `{"entries": [{"heuristic": "WeightedCount", "timeLimitMs": 100}]}`
+	handlePostTournament(rec, httptest.NewRequest("POST", "/tournament", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected a tournament with one player to be rejected, got %v", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handleGetTournament(rec, httptest.NewRequest("GET", "/tournament?id="+uuid.NewString(), nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected unknown tournament to not be found, got %v", rec.Code)
+	}
+}
@@ -15,6 +15,7 @@ type webhookRequestBody struct {
 	Mode      string          `json:"mode"`
 	Id        uuid.UUID       `json:"id"`
 	Result    core.GameResult `json:"result"`
+	Reason    string          `json:"reason,omitempty"`
 	Timestamp int64           `json:"timestamp"`
 }
 
@@ -23,6 +24,7 @@ func notifyWebhooks(mode gameMode, id uuid.UUID, state gameState, urls []string)
 		Mode:      mode.String(),
 		Id:        id,
 		Result:    state.result,
+		Reason:    state.reason,
 		Timestamp: time.Now().UnixMilli(),
 	}
 	bytes, err := json.Marshal(body)